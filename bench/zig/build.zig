@@ -0,0 +1,32 @@
+const std = @import("std");
+
+pub fn build(b: *std.Build) void {
+    const target = b.standardTargetOptions(.{});
+    const optimize = b.standardOptimizeOption(.{});
+
+    const run_step = b.step("run", "Run the benchmarks");
+    run_step.dependOn(&addBench(b, target, optimize).step);
+
+    const release_step = b.step("release-bench", "Run the benchmarks in ReleaseFast");
+    release_step.dependOn(&addBench(b, target, .ReleaseFast).step);
+}
+
+fn addBench(b: *std.Build, target: std.Build.ResolvedTarget, optimize: std.builtin.OptimizeMode) *std.Build.Step.Run {
+    const cbor_mod = b.createModule(.{
+        .root_source_file = b.path("../../src/root.zig"),
+        .target = target,
+        .optimize = optimize,
+    });
+
+    const exe = b.addExecutable(.{
+        .name = if (optimize == .ReleaseFast) "cbor-bench-release" else "cbor-bench",
+        .root_source_file = b.path("src/main.zig"),
+        .target = target,
+        .optimize = optimize,
+    });
+    exe.root_module.addImport("cbor", cbor_mod);
+
+    const run = b.addRunArtifact(exe);
+    if (b.args) |args| run.addArgs(args);
+    return run;
+}
@@ -0,0 +1,176 @@
+const std = @import("std");
+const cbor = @import("cbor");
+
+// Runs `func(args)` `iterations` times and prints the mean time per call.
+fn bench(name: []const u8, iterations: usize, comptime func: anytype, args: anytype) !void {
+    var timer = try std.time.Timer.start();
+    for (0..iterations) |_| {
+        const result = try @call(.auto, func, args);
+        std.mem.doNotOptimizeAway(result);
+    }
+    const ns = timer.read() / iterations;
+    std.debug.print("{s:<40} {d:>10} ns/op\n", .{ name, ns });
+}
+
+fn serializeStrings(serde: *cbor.Serde, strings: []const []const u8) !usize {
+    const bytes = try serde.serialize(strings);
+    defer serde.allocator.free(bytes);
+    return bytes.len;
+}
+
+// An optional child type keeps the encoder on the per-element reflective path.
+fn serializeOptionalStrings(serde: *cbor.Serde, strings: []const ?[]const u8) !usize {
+    const bytes = try serde.serialize(strings);
+    defer serde.allocator.free(bytes);
+    return bytes.len;
+}
+
+fn deserializeStrings(serde: *cbor.Serde, bytes: []const u8) !usize {
+    defer _ = serde.arena.reset(.retain_capacity);
+    const strings = try serde.deserialize(bytes, [][]const u8);
+    return strings.len;
+}
+
+fn benchStrings(allocator: std.mem.Allocator) !void {
+    var serde = cbor.Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const strings = try allocator.alloc([]const u8, 1000);
+    defer allocator.free(strings);
+    const optional_strings = try allocator.alloc(?[]const u8, strings.len);
+    defer allocator.free(optional_strings);
+    for (strings, optional_strings, 0..) |*s, *o, i| {
+        s.* = if (i % 2 == 0) "short" else "a bit longer string";
+        o.* = s.*;
+    }
+
+    const encoded = try serde.serialize(strings);
+    defer allocator.free(encoded);
+
+    try bench("serialize 1000 strings", 1000, serializeStrings, .{ &serde, strings });
+    try bench("serialize 1000 strings (generic path)", 1000, serializeOptionalStrings, .{ &serde, optional_strings });
+    try bench("deserialize 1000 strings", 1000, deserializeStrings, .{ &serde, encoded });
+}
+
+const TestData = struct {
+    id: u64,
+    name: []const u8,
+    email: []const u8,
+    age: u8,
+    active: bool,
+    score: f64,
+    country: []const u8,
+    city: []const u8,
+    zip: u32,
+    created_at: i64,
+    updated_at: i64,
+    tags: []const []const u8,
+};
+
+fn deserializeTestData(serde: *cbor.Serde, bytes: []const u8) !u64 {
+    defer _ = serde.arena.reset(.retain_capacity);
+    const data = try serde.deserialize(bytes, TestData);
+    return data.id;
+}
+
+fn benchStructDecode(allocator: std.mem.Allocator) !void {
+    var serde = cbor.Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const encoded = try serde.serialize(TestData{
+        .id = 42,
+        .name = "Lala Amarnath",
+        .email = "lala@example.com",
+        .age = 130,
+        .active = true,
+        .score = 99.5,
+        .country = "India",
+        .city = "Amritsar",
+        .zip = 143001,
+        .created_at = 1_700_000_000,
+        .updated_at = 1_700_000_100,
+        .tags = &.{ "cricket", "captain" },
+    });
+    defer allocator.free(encoded);
+
+    try bench("deserialize 12-field struct", 100_000, deserializeTestData, .{ &serde, encoded });
+}
+
+const BigEnum = blk: {
+    var fields: [100]std.builtin.Type.EnumField = undefined;
+    for (&fields, 0..) |*field, i| {
+        field.* = .{ .name = std.fmt.comptimePrint("variant_{d}", .{i}), .value = i };
+    }
+    break :blk @Type(.{ .@"enum" = .{
+        .tag_type = u8,
+        .fields = &fields,
+        .decls = &.{},
+        .is_exhaustive = true,
+    } });
+};
+
+fn deserializeEnum(serde: *cbor.Serde, bytes: []const u8) !BigEnum {
+    defer _ = serde.arena.reset(.retain_capacity);
+    return serde.deserialize(bytes, BigEnum);
+}
+
+fn benchEnumDecode(allocator: std.mem.Allocator) !void {
+    var serde = cbor.Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const first = try serde.serialize(BigEnum.variant_0);
+    defer allocator.free(first);
+    const last = try serde.serialize(BigEnum.variant_99);
+    defer allocator.free(last);
+
+    try bench("deserialize 100-variant enum (first)", 100_000, deserializeEnum, .{ &serde, first });
+    try bench("deserialize 100-variant enum (last)", 100_000, deserializeEnum, .{ &serde, last });
+}
+
+const Response = struct {
+    id: u32,
+    status: u16,
+    body: []const u8,
+};
+
+fn encodeFresh(serde: *cbor.Serde, count: usize) !usize {
+    var total: usize = 0;
+    for (0..count) |i| {
+        const bytes = try serde.serialize(Response{ .id = @intCast(i), .status = 200, .body = "ok" });
+        defer serde.allocator.free(bytes);
+        total += bytes.len;
+    }
+    return total;
+}
+
+fn encodeReused(serde: *cbor.Serde, count: usize) !usize {
+    var buffer = std.ArrayList(u8).init(serde.allocator);
+    defer buffer.deinit();
+    var encoder = cbor.Encoder{ .writer = buffer.writer() };
+    var total: usize = 0;
+    for (0..count) |i| {
+        encoder.reset();
+        try serde.serializeInto(&encoder, Response{ .id = @intCast(i), .status = 200, .body = "ok" });
+        total += encoder.finish().len;
+    }
+    return total;
+}
+
+fn benchEncoderReuse(allocator: std.mem.Allocator) !void {
+    var serde = cbor.Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    try bench("encode 10000 messages (fresh buffers)", 100, encodeFresh, .{ &serde, 10_000 });
+    try bench("encode 10000 messages (reset encoder)", 100, encodeReused, .{ &serde, 10_000 });
+}
+
+pub fn main() !void {
+    var gpa = std.heap.GeneralPurposeAllocator(.{}){};
+    defer _ = gpa.deinit();
+    const allocator = gpa.allocator();
+
+    try benchStrings(allocator);
+    try benchStructDecode(allocator);
+    try benchEnumDecode(allocator);
+    try benchEncoderReuse(allocator);
+}
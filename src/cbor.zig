@@ -1,23 +1,362 @@
 const std = @import("std");
+const builtin = @import("builtin");
 const Allocator = std.mem.Allocator;
 
-pub const Config = struct {
+pub const DecodeOptions = struct {
     max_nesting_depth: u32 = 64,
     max_allocation_size: usize = 16 * 1024 * 1024,
+    /// Cap on the total number of bytes allocated while decoding one value.
+    max_total_alloc: ?usize = null,
+    /// Fail with `error.DuplicateKey` when a map repeats a key or an enum set
+    /// repeats a member.
+    reject_duplicate_keys: bool = false,
+    /// Reject input that is not in core deterministic form (see
+    /// `validateCanonical`).
+    require_canonical: bool = false,
+    /// Called with the offset of each item head whose integer or length
+    /// argument is not in its shortest form. Decoding continues.
+    on_non_minimal: ?NonMinimalCallback = null,
+    /// Decode an empty buffer as null (optional targets) or an empty value
+    /// instead of failing with `error.EndOfStream`. Struct fields take their
+    /// defaults, else null, an empty slice or zero; a non-optional pointer
+    /// without a default is a compile error.
+    empty_as_null: bool = false,
+    /// Also accept structs sent as an array of `[key, value]` arrays.
+    accept_pair_arrays: bool = false,
+    /// Limit on the number of single-item pointers (e.g. nodes of a
+    /// `?*Node` list) allocated while decoding one value.
+    max_nodes: ?usize = null,
+    /// Accept the integers 0 and 1 for booleans.
+    int_bools: bool = false,
+    /// Parse text strings such as "42" or "3.14" into integer and float
+    /// targets.
+    parse_stringified_numbers: bool = false,
+    /// Accept byte strings where a text string is expected (enum names,
+    /// map keys, version strings).
+    bytes_as_text: bool = false,
+    /// Decode floats into `[]const u8` targets as the shortest decimal text
+    /// that reads back to the same value at its encoded width.
+    float_as_decimal_string: bool = false,
+    /// Limit on the chunks of one indefinite-length string. The joined
+    /// length is bounded by `max_allocation_size`.
+    max_string_chunks: usize = 1024,
+    /// Wire form expected for unions that don't declare `cbor_union_format`.
+    union_format: UnionFormat = .name_array,
 };
 
-pub const CborError = error{
-    OutOfMemory,
-    IoError,
+pub const NonMinimalCallback = struct {
+    context: ?*anyopaque = null,
+    func: *const fn (context: ?*anyopaque, offset: usize) void,
+};
+
+pub const EncodeOptions = struct {
+    /// Core deterministic encoding (RFC 8949 section 4.2.1): map keys sorted
+    /// bytewise and floats in their shortest lossless width.
+    deterministic: bool = false,
+    /// Emit arrays and maps with indefinite-length headers.
+    indefinite_length: bool = false,
+    /// ASCII-lowercase error names written by `Encoder.encodeErrorName`.
+    lowercase_error_names: bool = false,
+    /// Leave out struct fields whose optional value is null. `??T` fields
+    /// are left out whenever the outer optional is null, so that absent
+    /// stays apart from a present null.
+    omit_null_fields: bool = false,
+    /// Write booleans as the integers 0 and 1.
+    bool_as_int: bool = false,
+    /// Map key order on its own, without the rest of `deterministic`. When
+    /// `.none`, `deterministic` implies `.bytewise`.
+    sort_keys_by: KeyOrder = .none,
+    /// Write string literals as byte strings rather than text.
+    string_as_bytes: bool = false,
+    /// How `std.Uri` values are written.
+    uri_format: UriFormat = .text,
+    /// Wire form of unions that don't declare `cbor_union_format`.
+    union_format: UnionFormat = .name_array,
+    /// How a null optional slice is written.
+    null_slice: NullSlice = .null,
+    /// Struct key order when keys are not otherwise sorted. Structs with a
+    /// `cbor_extra` field always keep declared order.
+    struct_order: StructOrder = .declared,
+    /// Write bit sets of up to 64 bits as an unsigned integer mask (bit i
+    /// is `1 << i`) instead of a byte string.
+    bit_set_as_int: bool = false,
+
+    pub const KeyOrder = enum {
+        none,
+        /// Bytewise order of the encoded keys (RFC 8949 section 4.2.1).
+        bytewise,
+        /// Shorter encoded keys first, then bytewise (RFC 8949 section 4.2.3).
+        length_first,
+    };
+
+    pub const StructOrder = enum { declared, alphabetical };
+
+    pub const UriFormat = enum {
+        /// The URI text under tag 32 (RFC 8949 section 3.4.5.3).
+        text,
+        /// A map from component names ("scheme", "host", "port", ...) to
+        /// their percent-encoded text; the port is an integer.
+        components,
+    };
+
+    pub const NullSlice = enum {
+        /// CBOR null, kept apart from an empty slice.
+        null,
+        /// The same as an empty slice: an empty array, or an empty byte
+        /// string for `?[]const u8`.
+        empty_array,
+    };
+
+    fn check(self: EncodeOptions) CborError!void {
+        if (self.deterministic and self.indefinite_length) return error.ConflictingOptions;
+    }
+
+    fn keyOrder(self: EncodeOptions) KeyOrder {
+        if (self.sort_keys_by == .none and self.deterministic) return .bytewise;
+        return self.sort_keys_by;
+    }
+};
+
+pub const Config = struct {
+    encode: EncodeOptions = .{},
+    decode: DecodeOptions = .{},
+    /// Deprecated: set `decode.max_nesting_depth` instead.
+    max_nesting_depth: ?u32 = null,
+    /// Deprecated: set `decode.max_allocation_size` instead.
+    max_allocation_size: ?usize = null,
+};
+
+/// The input is not well-formed CBOR (or hex/JSON text, for the helpers
+/// that take those).
+pub const MalformedError = error{
     EndOfStream,
-    TypeMismatch,
-    NestingDepthExceeded,
-    AllocationTooLarge,
     UnsupportedMajorType,
     InvalidAdditionalInfo,
+    UnexpectedBreak,
+    TrailingBytes,
+    /// A chunk of an indefinite-length string is not a definite-length
+    /// string of the same major type.
+    InvalidStringChunk,
+    InvalidJson,
+    InvalidHex,
+};
+
+/// The input is well-formed but breaks a validity or profile rule.
+pub const InvalidError = error{
+    DuplicateKey,
+    IndefiniteInCanonical,
+    NonCanonicalInteger,
+    NonCanonicalFloat,
+    UnsortedMapKeys,
+    SimpleValueForbidden,
+    InvalidUtf8,
+    InvalidSemanticVersion,
+    InvalidUri,
+    InvalidNumber,
+    PatchMismatch,
+};
+
+/// Valid input that the target type or options can't represent.
+pub const UnsupportedError = error{
+    TypeMismatch,
     InvalidEnumTag,
     InvalidUnionRepresentation,
     MissingRequiredField,
+    ConflictingOptions,
+    UnsupportedAddressFamily,
+    IntegerOutOfRange,
+    InvalidPairArray,
+    LengthExceedsPlatform,
+    CapacityExceeded,
+    NoMatchingVariant,
+    UnknownCriticalKey,
+};
+
+/// A configured limit was hit, or memory or I/O failed.
+pub const ResourceError = error{
+    OutOfMemory,
+    IoError,
+    NestingDepthExceeded,
+    AllocationTooLarge,
+    AllocationBudgetExceeded,
+    TooManyNodes,
+    TooManyStringChunks,
+};
+
+pub const CborError = MalformedError || InvalidError || UnsupportedError || ResourceError;
+
+pub const ErrorCategory = enum { malformed, invalid, unsupported, resource };
+
+/// Which of the error sets making up `CborError` `err` belongs to, e.g. to
+/// reject malformed input outright but fall back on unsupported shapes.
+pub fn errorCategory(err: CborError) ErrorCategory {
+    if (inErrorSet(MalformedError, err)) return .malformed;
+    if (inErrorSet(InvalidError, err)) return .invalid;
+    if (inErrorSet(UnsupportedError, err)) return .unsupported;
+    return .resource;
+}
+
+fn inErrorSet(comptime E: type, err: anyerror) bool {
+    inline for (@typeInfo(E).error_set.?) |e| {
+        if (err == @field(E, e.name)) return true;
+    }
+    return false;
+}
+
+pub const DataItem = union(enum) {
+    uint: u64,
+    /// Negative integer with value `-1 - n`.
+    nint: u64,
+    bytes: []const u8,
+    text: []const u8,
+    array: []const DataItem,
+    map: []const Pair,
+    tag: Tag,
+    float: Float,
+    bool: bool,
+    null,
+    undefined,
+    simple: u8,
+
+    pub const Pair = struct {
+        key: DataItem,
+        value: DataItem,
+    };
+
+    pub const Tag = struct {
+        number: u64,
+        content: *const DataItem,
+    };
+
+    pub const Float = struct {
+        value: f64,
+        /// Width the value had on the wire; re-encoding uses it unless the
+        /// encoder is deterministic.
+        width: Width = .f64,
+
+        pub const Width = enum { f16, f32, f64 };
+    };
+};
+
+/// Chainable construction of `DataItem` trees:
+///
+///     var map = Builder.map(arena);
+///     const item = try map.put("a", Builder.int(1)).putArray("b", &.{.null}).build();
+///
+/// Memory comes from `allocator`, which is best an arena. An allocation
+/// failure is remembered and returned by `build`.
+pub const Builder = struct {
+    pub fn map(allocator: Allocator) Map {
+        return .{ .allocator = allocator };
+    }
+
+    pub fn array(allocator: Allocator) Array {
+        return .{ .allocator = allocator };
+    }
+
+    pub fn int(value: i64) DataItem {
+        if (value < 0) return .{ .nint = @intCast(-(value + 1)) };
+        return .{ .uint = @intCast(value) };
+    }
+
+    pub fn text(value: []const u8) DataItem {
+        return .{ .text = value };
+    }
+
+    pub const Map = struct {
+        allocator: Allocator,
+        pairs: std.ArrayListUnmanaged(DataItem.Pair) = .empty,
+        err: ?Allocator.Error = null,
+
+        /// Adds an entry with a text key.
+        pub fn put(self: *Map, key: []const u8, value: DataItem) *Map {
+            return self.putItem(.{ .text = key }, value);
+        }
+
+        pub fn putItem(self: *Map, key: DataItem, value: DataItem) *Map {
+            if (self.err == null) {
+                self.pairs.append(self.allocator, .{ .key = key, .value = value }) catch |err| {
+                    self.err = err;
+                };
+            }
+            return self;
+        }
+
+        pub fn putArray(self: *Map, key: []const u8, items: []const DataItem) *Map {
+            const copy = self.allocator.dupe(DataItem, items) catch |err| {
+                self.err = err;
+                return self;
+            };
+            return self.put(key, .{ .array = copy });
+        }
+
+        pub fn putMap(self: *Map, key: []const u8, child: *Map) *Map {
+            const item = child.build() catch |err| {
+                self.err = err;
+                return self;
+            };
+            return self.put(key, item);
+        }
+
+        pub fn build(self: *Map) Allocator.Error!DataItem {
+            if (self.err) |err| return err;
+            return .{ .map = try self.pairs.toOwnedSlice(self.allocator) };
+        }
+    };
+
+    pub const Array = struct {
+        allocator: Allocator,
+        items: std.ArrayListUnmanaged(DataItem) = .empty,
+        err: ?Allocator.Error = null,
+
+        pub fn append(self: *Array, value: DataItem) *Array {
+            if (self.err == null) {
+                self.items.append(self.allocator, value) catch |err| {
+                    self.err = err;
+                };
+            }
+            return self;
+        }
+
+        pub fn appendMap(self: *Array, child: *Map) *Array {
+            const item = child.build() catch |err| {
+                self.err = err;
+                return self;
+            };
+            return self.append(item);
+        }
+
+        pub fn build(self: *Array) Allocator.Error!DataItem {
+            if (self.err) |err| return err;
+            return .{ .array = try self.items.toOwnedSlice(self.allocator) };
+        }
+    };
+};
+
+/// A data item kept in its encoded form. As a struct field it captures the
+/// value's bytes without parsing them, to be decoded later with `decode`.
+pub const RawCbor = struct {
+    bytes: []const u8,
+
+    pub fn decode(self: RawCbor, serde: *Serde, comptime T: type) CborError!T {
+        return serde.deserialize(self.bytes, T);
+    }
+};
+
+/// Receives any simple value (major type 7, other than floats and break),
+/// including false, true, null and undefined as 20 to 23.
+pub const SimpleValue = struct {
+    value: u8,
+};
+
+/// Tag 1001 extended time (RFC 9581): a map with the epoch seconds under key
+/// 1 and the fraction of a second under -3, -6 or -9 (milli-, micro- or
+/// nanoseconds). Unknown elective (positive) keys are skipped on decode;
+/// unknown critical (negative) ones fail with `error.UnknownCriticalKey`.
+pub const ExtendedTime = struct {
+    seconds: i64,
+    /// Always below one second.
+    nanos: u32 = 0,
 };
 
 pub const Serde = struct {
@@ -27,11 +366,14 @@ pub const Serde = struct {
     config: Config,
 
     pub fn init(allocator: Allocator, config: Config) Serde {
+        var resolved = config;
+        if (config.max_nesting_depth) |depth| resolved.decode.max_nesting_depth = depth;
+        if (config.max_allocation_size) |size| resolved.decode.max_allocation_size = size;
         return .{
             .allocator = allocator,
             .arena = std.heap.ArenaAllocator.init(allocator),
             .buffer = std.ArrayList(u8).init(allocator),
-            .config = config,
+            .config = resolved,
         };
     }
 
@@ -41,112 +383,662 @@ pub const Serde = struct {
     }
 
     pub fn serialize(self: *Serde, value: anytype) CborError![]u8 {
+        try self.config.encode.check();
         if (self.buffer.items.len > 0) self.buffer.clearRetainingCapacity(); // Clear previous data
-        var encoder = Encoder{ .writer = self.buffer.writer() };
+        var encoder = Encoder{ .writer = self.buffer.writer(), .options = self.config.encode };
+        try self.serializeValue(&encoder, value);
+        return self.buffer.toOwnedSlice();
+    }
+
+    /// Like `serialize`, with the top-level item wrapped in tag `tag`.
+    pub fn encodeTagged(self: *Serde, tag: u64, value: anytype) CborError![]u8 {
+        try self.config.encode.check();
+        if (self.buffer.items.len > 0) self.buffer.clearRetainingCapacity();
+        var encoder = Encoder{ .writer = self.buffer.writer(), .options = self.config.encode };
+        try encoder.encodeUInt(6, tag);
         try self.serializeValue(&encoder, value);
         return self.buffer.toOwnedSlice();
     }
 
+    /// Appends the encoding of `value` to `encoder`, which may be reused
+    /// across messages with `Encoder.reset`.
+    pub fn serializeInto(self: *Serde, encoder: *Encoder, value: anytype) CborError!void {
+        try encoder.options.check();
+        try self.serializeValue(encoder, value);
+    }
+
+    /// Parses JSON text and returns its CBOR encoding.
+    pub fn fromJson(self: *Serde, text: []const u8) CborError![]u8 {
+        try self.config.encode.check();
+        const parsed = std.json.parseFromSlice(std.json.Value, self.allocator, text, .{}) catch |err| switch (err) {
+            error.OutOfMemory => return error.OutOfMemory,
+            else => return error.InvalidJson,
+        };
+        defer parsed.deinit();
+        if (self.buffer.items.len > 0) self.buffer.clearRetainingCapacity();
+        var encoder = Encoder{ .writer = self.buffer.writer(), .options = self.config.encode };
+        try encoder.encodeJsonValue(parsed.value);
+        return self.buffer.toOwnedSlice();
+    }
+
     pub fn deserialize(
         self: *Serde,
         bytes: []const u8,
         comptime T: type,
     ) CborError!T {
-        var decoder = Decoder.init(&self.arena, bytes, self.config);
+        if (bytes.len == 0 and self.config.decode.empty_as_null) {
+            return emptyValue(T);
+        }
+        if (self.config.decode.require_canonical) try validateCanonical(bytes);
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
         return self.deserializeValue(&decoder, T);
     }
 
-    fn serializeValue(self: *const Serde, encoder: *Encoder, value: anytype) !void {
+    /// Returns a decoder over `bytes` for reading a sequence of items with
+    /// `deserializeNext`.
+    pub fn sequenceDecoder(self: *Serde, bytes: []const u8) Decoder {
+        return Decoder.init(&self.arena, bytes, self.config.decode);
+    }
+
+    /// Decodes the next item of a sequence.
+    pub fn deserializeNext(self: *Serde, dec: *Decoder, comptime T: type) CborError!T {
+        return self.deserializeValue(dec, T);
+    }
+
+    /// Returns an encoder that writes a sequence of items into this Serde's
+    /// buffer. Calling `serialize` before the sequence is finished discards it.
+    pub fn sequenceEncoder(self: *Serde) CborError!SequenceEncoder {
+        try self.config.encode.check();
+        self.buffer.clearRetainingCapacity();
+        return .{
+            .serde = self,
+            .encoder = .{ .writer = self.buffer.writer(), .options = self.config.encode },
+        };
+    }
+
+    fn serializeValue(self: *const Serde, encoder: *Encoder, value: anytype) CborError!void {
         const T = @TypeOf(value);
         const info = @typeInfo(T);
 
+        if (T == DataItem) return encoder.encodeDataItem(value);
+        if (T == RawCbor) return encoder.writeRaw(value.bytes);
+        if (T == SimpleValue) return encoder.encodeDataItem(.{ .simple = value.value });
+        if (comptime hasStreamEncoder(T)) return value.encodeCborStream(encoder);
+
         switch (info) {
             .@"struct" => {
+                if (T == std.SemanticVersion) {
+                    try encoder.encodeUInt(3, std.fmt.count("{}", .{value}));
+                    return encoder.writer.print("{}", .{value});
+                }
+                if (T == std.Uri) return serializeUri(encoder, value);
+                if (T == ExtendedTime) return self.serializeExtendedTime(encoder, value);
+                if (comptime isBoundedArray(T)) return self.serializeValue(encoder, value.constSlice());
+                if (comptime isArrayListUnmanaged(T)) return self.serializeValue(encoder, value.items);
+                if (comptime isEnumSet(T)) {
+                    try encoder.beginArray(value.count());
+                    var it = value.iterator();
+                    while (it.next()) |member| try encoder.encodeString(@tagName(member));
+                    return encoder.endContainer();
+                }
+                if (comptime isEnumMap(T)) {
+                    var entries = try encoder.beginMap(value.count());
+                    errdefer entries.discard();
+                    var it = value.iterator();
+                    while (it.next()) |entry| {
+                        entries.key();
+                        try self.serializeValue(encoder, entry.key);
+                        entries.value();
+                        try self.serializeValue(encoder, entry.value.*);
+                    }
+                    return entries.finish();
+                }
+                // Tuples are positional: an array of their elements.
+                if (comptime @typeInfo(T).@"struct".is_tuple) {
+                    try encoder.beginArray(std.meta.fields(T).len);
+                    inline for (value) |element| try self.serializeValue(encoder, element);
+                    return encoder.endContainer();
+                }
+                if (comptime isPackedIntArray(T)) {
+                    try encoder.beginArray(T.len);
+                    for (0..T.len) |i| try self.serializeValue(encoder, value.get(i));
+                    return encoder.endContainer();
+                }
+                if (comptime isBitSet(T)) {
+                    if (T.bit_length <= 64 and encoder.options.bit_set_as_int) {
+                        var mask: u64 = 0;
+                        for (0..T.bit_length) |i| {
+                            if (value.isSet(i)) mask |= @as(u64, 1) << @intCast(i);
+                        }
+                        return encoder.encodeUInt(0, mask);
+                    }
+                    var bytes = [_]u8{0} ** bitSetByteLen(T);
+                    for (0..T.bit_length) |i| {
+                        if (value.isSet(i)) bytes[i / 8] |= @as(u8, 1) << @intCast(i % 8);
+                    }
+                    return encoder.encodeBytes(&bytes);
+                }
+                if (comptime isStaticStringMap(T)) {
+                    const keys = value.keys();
+                    var entries = try encoder.beginMap(keys.len);
+                    errdefer entries.discard();
+                    for (keys, value.values()) |key, item| {
+                        entries.key();
+                        try encoder.encodeString(key);
+                        entries.value();
+                        try self.serializeValue(encoder, item);
+                    }
+                    return entries.finish();
+                }
+                if (comptime isHashMap(T) or isUnmanagedHashMap(T)) {
+                    var entries = try encoder.beginMap(value.count());
+                    errdefer entries.discard();
+                    var it = value.iterator();
+                    while (it.next()) |entry| {
+                        entries.key();
+                        try self.serializeMapKey(encoder, entry.key_ptr.*);
+                        entries.value();
+                        try self.serializeValue(encoder, entry.value_ptr.*);
+                    }
+                    return entries.finish();
+                }
                 const fields = std.meta.fields(T);
-                try encoder.encodeMapHeader(fields.len);
+                const extra_name = comptime extraFieldName(T);
+                var named_len: usize = comptime keyedFieldCount(T);
+                const extra_len: usize = if (extra_name != null) @field(value, extra_name.?).count() else 0;
+                inline for (fields) |field| {
+                    if (comptime !isKeyedField(T, field.name)) continue;
+                    if (isOmittedField(encoder.options, @field(value, field.name))) named_len -= 1;
+                }
+
+                // Without a catch-all field every key is known up front, so the
+                // sorted order is worked out at comptime and nothing is allocated.
+                if (extra_name == null) {
+                    switch (encoder.options.keyOrder()) {
+                        .none => if (encoder.options.struct_order == .alphabetical) {
+                            return self.serializeFields(encoder, value, comptime alphabeticalFieldNames(T), named_len);
+                        },
+                        inline else => |order| return self.serializeFields(encoder, value, comptime sortedFieldNames(T, order), named_len),
+                    }
+                }
+
+                var entries = try encoder.beginMap(named_len + extra_len);
+                errdefer entries.discard();
                 inline for (fields) |field| {
-                    try encoder.encodeString(field.name);
+                    if (comptime !isKeyedField(T, field.name)) continue;
+                    if (isOmittedField(encoder.options, @field(value, field.name))) continue;
+                    entries.key();
+                    if (comptime fieldIntKey(T, field.name)) |int_key| {
+                        try self.serializeValue(encoder, @as(i64, int_key));
+                    } else {
+                        try encoder.encodeString(field.name);
+                    }
+                    entries.value();
                     try self.serializeValue(encoder, @field(value, field.name));
                 }
+                if (extra_name != null) {
+                    var it = @field(value, extra_name.?).iterator();
+                    while (it.next()) |entry| {
+                        entries.key();
+                        try encoder.encodeString(entry.key_ptr.*);
+                        entries.value();
+                        try self.serializeValue(encoder, entry.value_ptr.*);
+                    }
+                }
+                try entries.finish();
             },
             .pointer => |ptr| switch (ptr.size) {
                 .slice => {
                     if (ptr.child == u8) {
                         try encoder.encodeBytes(value);
+                    } else if (comptime isByteSlice(ptr.child)) {
+                        try encoder.beginArray(value.len);
+                        for (value) |item| try encoder.encodeBytes(item);
+                        try encoder.endContainer();
                     } else {
                         const items = value;
-                        try encoder.encodeArrayHeader(items.len);
+                        try encoder.beginArray(items.len);
                         for (items) |item| {
                             try self.serializeValue(encoder, item);
                         }
+                        try encoder.endContainer();
+                    }
+                },
+                .one => {
+                    if (comptime isStringLiteral(T)) {
+                        if (encoder.options.string_as_bytes) return encoder.encodeBytes(value);
+                        return encoder.encodeString(value);
                     }
+                    try self.serializeValue(encoder, value.*);
                 },
                 else => @compileError("Unsupported pointer type: " ++ @typeName(T)),
             },
-            .optional => |_| {
+            .array => |arr| {
+                if (arr.child == u8) return encoder.encodeBytes(&value);
+                try encoder.beginArray(arr.len);
+                for (value) |item| try self.serializeValue(encoder, item);
+                try encoder.endContainer();
+            },
+            .vector => |vec| {
+                const lanes: [vec.len]vec.child = value;
+                try encoder.beginArray(vec.len);
+                for (lanes) |lane| try self.serializeValue(encoder, lane);
+                try encoder.endContainer();
+            },
+            .optional => |opt| {
                 if (value) |val| {
                     try self.serializeValue(encoder, val);
+                } else if (comptime isSlice(opt.child)) {
+                    switch (encoder.options.null_slice) {
+                        .null => try encoder.encodeNull(),
+                        .empty_array => try self.serializeValue(encoder, @as(opt.child, &.{})),
+                    }
                 } else {
                     try encoder.encodeNull();
                 }
             },
             .@"enum" => try encoder.encodeString(@tagName(value)),
             .@"union" => |union_info| {
+                if (comptime isNetAddress(T)) {
+                    try encoder.beginArray(2);
+                    switch (value.any.family) {
+                        std.posix.AF.INET => try encoder.encodeBytes(std.mem.asBytes(&value.in.sa.addr)),
+                        std.posix.AF.INET6 => try encoder.encodeBytes(&value.in6.sa.addr),
+                        else => return error.UnsupportedAddressFamily,
+                    }
+                    try self.serializeValue(encoder, value.getPort());
+                    return encoder.endContainer();
+                }
                 if (union_info.tag_type == null) @compileError("Only tagged unions are supported.");
-                try encoder.encodeArrayHeader(2);
-                try encoder.encodeString(@tagName(value));
+                const format = unionFormat(T, encoder.options.union_format);
+                switch (format) {
+                    .name_array => {
+                        try encoder.beginArray(2);
+                        try encoder.encodeString(@tagName(value));
+                    },
+                    .int_array => {
+                        try encoder.beginArray(2);
+                        try self.serializeValue(encoder, @intFromEnum(std.meta.activeTag(value)));
+                    },
+                    .single_key_map => {
+                        try encoder.beginMapHeader(1);
+                        try encoder.encodeString(@tagName(value));
+                    },
+                    .untagged => {},
+                }
                 switch (value) {
                     inline else => |payload| try self.serializeValue(encoder, payload),
                 }
+                if (format != .untagged) try encoder.endContainer();
             },
             .int => |int_info| {
-                if (int_info.signedness == .signed and value < 0) {
-                    try encoder.encodeUInt(1, @intCast(-(value + 1)));
+                // Magnitudes beyond 64 bits become tag 2/3 bignums.
+                const Magnitude = std.meta.Int(.unsigned, int_info.bits);
+                const negative = int_info.signedness == .signed and value < 0;
+                const magnitude: Magnitude = if (negative) @abs(value + 1) else @abs(value);
+                if (std.math.cast(u64, magnitude)) |small| {
+                    try encoder.encodeUInt(if (negative) 1 else 0, small);
                 } else {
-                    try encoder.encodeUInt(0, @intCast(value));
+                    try encoder.encodeBignum(negative, magnitude);
                 }
             },
             .float => |float_info| switch (float_info.bits) {
-                32 => try encoder.encodeFloat32(@floatCast(value)),
-                64 => try encoder.encodeFloat64(@floatCast(value)),
+                32 => {
+                    if (encoder.options.deterministic) return encoder.encodeFloat(value);
+                    try encoder.encodeFloat32(@floatCast(value));
+                },
+                64 => try encoder.encodeFloat(value),
                 else => @compileError("Unsupported float size."),
             },
-            .bool => try encoder.encodeBool(value),
+            .bool => {
+                if (encoder.options.bool_as_int) return encoder.encodeUInt(0, @intFromBool(value));
+                try encoder.encodeBool(value);
+            },
+            .error_set => try encoder.encodeErrorName(value),
+            // `{"ok": payload}` or `{"err": error_name}`.
+            .error_union => {
+                try encoder.beginMapHeader(1);
+                if (value) |payload| {
+                    try encoder.encodeString("ok");
+                    try self.serializeValue(encoder, payload);
+                } else |err| {
+                    try encoder.encodeString("err");
+                    try encoder.encodeErrorName(err);
+                }
+                try encoder.endContainer();
+            },
+            .void => try encoder.encodeNull(),
             else => @compileError("Unsupported type for serialization: " ++ @typeName(T)),
         }
     }
 
+    // Decodes the first union variant, in declaration order, that accepts the
+    // item. Each attempt starts over from the same position; running out of
+    // memory or hitting a limit is not retried.
+    fn deserializeUntagged(self: *const Serde, decoder: *Decoder, comptime T: type) CborError!T {
+        const start = decoder.stream.pos;
+        const nodes = decoder.nodes;
+        inline for (@typeInfo(T).@"union".fields) |field| {
+            decoder.stream.pos = start;
+            decoder.nodes = nodes;
+            if (self.deserializeValue(decoder, field.type)) |payload| {
+                return @unionInit(T, field.name, payload);
+            } else |err| {
+                if (errorCategory(err) == .resource) return err;
+            }
+        }
+        decoder.stream.pos = start;
+        return error.NoMatchingVariant;
+    }
+
+    // Writes the keyed fields of a struct as a map, in the order of `names`.
+    fn serializeFields(self: *const Serde, encoder: *Encoder, value: anytype, comptime names: anytype, len: usize) CborError!void {
+        const T = @TypeOf(value);
+        try encoder.beginMapHeader(len);
+        inline for (names) |name| {
+            if (isOmittedField(encoder.options, @field(value, name))) continue;
+            try encoder.writer.writeAll(comptime encodedFieldKey(T, name));
+            try self.serializeValue(encoder, @field(value, name));
+        }
+        return encoder.endContainer();
+    }
+
+    // String keys of hash maps are written as text strings, like struct keys.
+    fn serializeMapKey(self: *const Serde, encoder: *Encoder, key: anytype) CborError!void {
+        if (@TypeOf(key) == []const u8 or @TypeOf(key) == []u8) return encoder.encodeString(key);
+        try self.serializeValue(encoder, key);
+    }
+
+    fn serializeUri(encoder: *Encoder, uri: std.Uri) CborError!void {
+        if (encoder.options.uri_format == .text) {
+            try encoder.encodeUInt(6, 32);
+            try encoder.encodeUInt(3, std.fmt.count("{}", .{uri}));
+            return encoder.writer.print("{}", .{uri});
+        }
+
+        var len: usize = 2;
+        inline for (.{ "user", "password", "host", "port", "query", "fragment" }) |name| {
+            if (@field(uri, name) != null) len += 1;
+        }
+        var entries = try encoder.beginMap(len);
+        errdefer entries.discard();
+        entries.key();
+        try encoder.encodeString("scheme");
+        entries.value();
+        try encoder.encodeString(uri.scheme);
+        inline for (.{ "user", "password", "host", "port", "path", "query", "fragment" }) |name| {
+            const field = @field(uri, name);
+            const present = if (@typeInfo(@TypeOf(field)) == .optional) field != null else true;
+            if (present) {
+                entries.key();
+                try encoder.encodeString(name);
+                entries.value();
+                if (comptime std.mem.eql(u8, name, "port")) {
+                    try encoder.encodeUInt(0, field.?);
+                } else {
+                    // Components are written percent-encoded whichever form
+                    // they are held in, so decoding can store them as such.
+                    const component: std.Uri.Component = if (@typeInfo(@TypeOf(field)) == .optional) field.? else field;
+                    const spec = "{" ++ name ++ "}";
+                    try encoder.encodeUInt(3, std.fmt.count(spec, .{component}));
+                    try encoder.writer.print(spec, .{component});
+                }
+            }
+        }
+        try entries.finish();
+    }
+
+    fn deserializeUri(self: *const Serde, decoder: *Decoder) CborError!std.Uri {
+        if ((try decoder.peekByte()) >> 5 == 6) {
+            const head = try decoder.readByte();
+            if (try decoder.decodeUIntPayload(head & 0x1F) != 32) return error.TypeMismatch;
+            const text = try decoder.decodeString();
+            return std.Uri.parse(text) catch error.InvalidUri;
+        }
+
+        var uri = std.Uri{ .scheme = "" };
+        var has_scheme = false;
+        const len = try decoder.decodeMapHeader();
+        var i: u64 = 0;
+        while (try decoder.hasNext(len, i)) : (i += 1) {
+            const key = try decoder.decodeString();
+            const field = comptime fieldNameMap(std.Uri);
+            switch (field.get(key) orelse {
+                try decoder.skipValue();
+                continue;
+            }) {
+                .scheme => {
+                    uri.scheme = try decoder.decodeString();
+                    has_scheme = true;
+                },
+                .port => uri.port = try self.deserializeValue(decoder, u16),
+                .path => uri.path = .{ .percent_encoded = try decoder.decodeString() },
+                inline else => |tag| @field(uri, @tagName(tag)) = .{ .percent_encoded = try decoder.decodeString() },
+            }
+        }
+        if (!has_scheme) return error.MissingRequiredField;
+        return uri;
+    }
+
+    // The fraction goes under the coarsest key that holds it exactly.
+    fn serializeExtendedTime(self: *const Serde, encoder: *Encoder, time: ExtendedTime) CborError!void {
+        try encoder.encodeUInt(6, 1001);
+        var entries = try encoder.beginMap(if (time.nanos == 0) 1 else 2);
+        errdefer entries.discard();
+        entries.key();
+        try encoder.encodeUInt(0, 1);
+        entries.value();
+        try self.serializeValue(encoder, time.seconds);
+        if (time.nanos != 0) {
+            entries.key();
+            if (time.nanos % std.time.ns_per_ms == 0) {
+                try encoder.encodeUInt(1, 2);
+                entries.value();
+                try encoder.encodeUInt(0, time.nanos / std.time.ns_per_ms);
+            } else if (time.nanos % std.time.ns_per_us == 0) {
+                try encoder.encodeUInt(1, 5);
+                entries.value();
+                try encoder.encodeUInt(0, time.nanos / std.time.ns_per_us);
+            } else {
+                try encoder.encodeUInt(1, 8);
+                entries.value();
+                try encoder.encodeUInt(0, time.nanos);
+            }
+        }
+        try entries.finish();
+    }
+
+    fn deserializeExtendedTime(self: *const Serde, decoder: *Decoder) CborError!ExtendedTime {
+        const head = try decoder.readByte();
+        if (head >> 5 != 6 or try decoder.decodeUIntPayload(head & 0x1F) != 1001) return error.TypeMismatch;
+        var time = ExtendedTime{ .seconds = 0 };
+        var has_seconds = false;
+        const len = try decoder.decodeMapHeader();
+        var i: u64 = 0;
+        while (try decoder.hasNext(len, i)) : (i += 1) {
+            const key = try self.deserializeValue(decoder, i64);
+            switch (key) {
+                1 => {
+                    time.seconds = try self.deserializeValue(decoder, i64);
+                    has_seconds = true;
+                },
+                -3, -6, -9 => {
+                    const scale: u32 = switch (key) {
+                        -3 => std.time.ns_per_ms,
+                        -6 => std.time.ns_per_us,
+                        else => 1,
+                    };
+                    const fraction = try self.deserializeValue(decoder, u32);
+                    if (fraction >= std.time.ns_per_s / scale) return error.IntegerOutOfRange;
+                    time.nanos = fraction * scale;
+                },
+                else => {
+                    if (key < 0) return error.UnknownCriticalKey;
+                    try decoder.skipValue();
+                },
+            }
+        }
+        if (!has_seconds) return error.MissingRequiredField;
+        return time;
+    }
+
     fn deserializeValue(self: *const Serde, decoder: *Decoder, comptime T: type) CborError!T {
         const info = @typeInfo(T);
 
+        // Breaks that end indefinite-length containers are consumed by
+        // `hasNext`, so one found here sits inside a definite-length item.
+        if ((try decoder.peekByte()) == 0xff) return error.UnexpectedBreak;
+
+        if (T == DataItem) return decoder.decodeDataItem();
+        if (T == RawCbor) return .{ .bytes = try decoder.captureRaw() };
+        if (T == SimpleValue) return .{ .value = try decoder.decodeSimple() };
+
         return switch (info) {
             .@"struct" => {
+                if (T == std.SemanticVersion) {
+                    const text = try decoder.decodeString();
+                    return std.SemanticVersion.parse(text) catch error.InvalidSemanticVersion;
+                }
+                if (T == std.Uri) return self.deserializeUri(decoder);
+                if (T == ExtendedTime) return self.deserializeExtendedTime(decoder);
+                if (comptime isBoundedArray(T)) {
+                    var result = T{};
+                    const Child = @typeInfo(@FieldType(T, "buffer")).array.child;
+                    if (Child == u8) {
+                        result.len = try decoder.decodeBytesInto(&result.buffer);
+                        return result;
+                    }
+                    const len = try decoder.decodeArrayHeader();
+                    var i: u64 = 0;
+                    while (try decoder.hasNext(len, i)) : (i += 1) {
+                        result.append(try self.deserializeValue(decoder, Child)) catch return error.CapacityExceeded;
+                    }
+                    return result;
+                }
+                if (comptime isArrayListUnmanaged(T)) {
+                    const items = try self.deserializeValue(decoder, @FieldType(T, "items"));
+                    return .{ .items = items, .capacity = items.len };
+                }
+                if (comptime isStaticStringMap(T)) {
+                    @compileError("StaticStringMap is built at comptime; decode into a StringHashMap instead");
+                }
+                if (comptime isHashMap(T) or isUnmanagedHashMap(T)) {
+                    const K = @FieldType(T.KV, "key");
+                    const V = @FieldType(T.KV, "value");
+                    const managed = comptime isHashMap(T);
+                    var map: T = if (managed) T.init(decoder.allocator()) else .empty;
+                    const len = try decoder.decodeMapHeader();
+                    var i: u64 = 0;
+                    while (try decoder.hasNext(len, i)) : (i += 1) {
+                        const key = try self.deserializeValue(decoder, K);
+                        const gop = (if (managed) map.getOrPut(key) else map.getOrPut(decoder.allocator(), key)) catch
+                            return decoder.allocError();
+                        if (gop.found_existing and decoder.options.reject_duplicate_keys) return error.DuplicateKey;
+                        gop.value_ptr.* = try self.deserializeValue(decoder, V);
+                    }
+                    if (managed) map.allocator = decoder.persistentAllocator();
+                    return map;
+                }
+                if (comptime isEnumSet(T)) {
+                    var set = T.initEmpty();
+                    const len = try decoder.decodeArrayHeader();
+                    var i: u64 = 0;
+                    while (try decoder.hasNext(len, i)) : (i += 1) {
+                        const member = try self.deserializeValue(decoder, T.Key);
+                        if (decoder.options.reject_duplicate_keys and set.contains(member)) return error.DuplicateKey;
+                        set.insert(member);
+                    }
+                    return set;
+                }
+                // Keys missing from the map stay absent.
+                if (comptime isEnumMap(T)) {
+                    var result: T = .{};
+                    const len = try decoder.decodeMapHeader();
+                    var i: u64 = 0;
+                    while (try decoder.hasNext(len, i)) : (i += 1) {
+                        const key = try self.deserializeValue(decoder, T.Key);
+                        if (decoder.options.reject_duplicate_keys and result.contains(key)) return error.DuplicateKey;
+                        result.put(key, try self.deserializeValue(decoder, T.Value));
+                    }
+                    return result;
+                }
+                // Tuples need exactly one array element per field.
+                if (comptime @typeInfo(T).@"struct".is_tuple) {
+                    var result: T = undefined;
+                    const len = try decoder.decodeArrayHeader();
+                    inline for (std.meta.fields(T), 0..) |field, j| {
+                        if (!try decoder.hasNext(len, j)) return error.TypeMismatch;
+                        @field(result, field.name) = try self.deserializeValue(decoder, field.type);
+                    }
+                    if (try decoder.hasNext(len, std.meta.fields(T).len)) return error.TypeMismatch;
+                    return result;
+                }
+                if (comptime isPackedIntArray(T)) {
+                    var result: T = undefined;
+                    const len = try decoder.decodeArrayHeader();
+                    for (0..T.len) |j| {
+                        if (!try decoder.hasNext(len, j)) return error.TypeMismatch;
+                        result.set(j, try self.deserializeValue(decoder, T.Child));
+                    }
+                    if (try decoder.hasNext(len, T.len)) return error.TypeMismatch;
+                    return result;
+                }
+                if (comptime isBitSet(T)) {
+                    if (T.bit_length <= 64 and (try decoder.peekByte()) >> 5 == 0) {
+                        const mask = try self.deserializeValue(decoder, u64);
+                        if (T.bit_length < 64 and mask >> @intCast(T.bit_length) != 0) return error.TypeMismatch;
+                        var result = T.initEmpty();
+                        for (0..T.bit_length) |i| {
+                            if ((mask >> @intCast(i)) & 1 != 0) result.set(i);
+                        }
+                        return result;
+                    }
+                    const bytes = try decoder.decodeBytes();
+                    if (bytes.len != bitSetByteLen(T)) return error.TypeMismatch;
+                    var result = T.initEmpty();
+                    for (0..bytes.len * 8) |i| {
+                        if ((bytes[i / 8] >> @intCast(i % 8)) & 1 == 0) continue;
+                        if (i >= T.bit_length) return error.TypeMismatch;
+                        result.set(i);
+                    }
+                    return result;
+                }
                 var result: T = undefined;
-                if ((try decoder.peekByte()) >> 5 != 5) return error.TypeMismatch;
-                const map_len = try decoder.decodeMapHeader();
+                const major_type = (try decoder.peekByte()) >> 5;
+                const pair_array = major_type == 4 and decoder.options.accept_pair_arrays;
+                if (major_type != 5 and !pair_array) return error.TypeMismatch;
+                const map_len = if (pair_array) try decoder.decodeArrayHeader() else try decoder.decodeMapHeader();
 
                 var populated_fields: u64 = 0;
                 const fields = std.meta.fields(T);
                 if (fields.len > 64) @compileError("Structs with >64 fields not supported.");
 
-                var i: u64 = 0;
-                while (i < map_len) : (i += 1) {
-                    const key = try decoder.decodeString();
-                    var found_key = false;
-                    inline for (fields, 0..) |field, field_idx| {
-                        if (std.mem.eql(u8, key, field.name)) {
-                            @field(result, field.name) = try self.deserializeValue(decoder, field.type);
-                            populated_fields |= (@as(u64, 1) << @intCast(field_idx));
-                            found_key = true;
-                            break;
-                        }
+                const extra_name = comptime extraFieldName(T);
+                if (extra_name != null) {
+                    @field(result, extra_name.?) = @FieldType(T, extra_name.?).init(decoder.allocator());
+                    populated_fields |= @as(u64, 1) << @intCast(std.meta.fieldIndex(T, extra_name.?).?);
+                }
+                inline for (fields, 0..) |field, field_idx| {
+                    if (comptime isSkippedField(T, field.name)) {
+                        @field(result, field.name) = comptime fieldDefault(field) orelse std.mem.zeroes(field.type);
+                        populated_fields |= @as(u64, 1) << @intCast(field_idx);
                     }
-                    if (!found_key) try decoder.skipValue();
                 }
 
+                try self.deserializeFields(decoder, T, &result, map_len, pair_array, &populated_fields);
+                if (extra_name != null) @field(result, extra_name.?).allocator = decoder.persistentAllocator();
+
                 inline for (fields, 0..) |field, field_idx| {
                     if ((populated_fields & (@as(u64, 1) << @intCast(field_idx))) == 0) {
-                        if (@hasField(@TypeOf(field), "default_value")) {
+                        if (@hasField(@TypeOf(field), "default_value_ptr")) {
+                            if (comptime fieldDefault(field)) |default_val| {
+                                @field(result, field.name) = default_val;
+                            } else if (@typeInfo(field.type) == .optional) {
+                                @field(result, field.name) = null;
+                            } else {
+                                return error.MissingRequiredField;
+                            }
+                        } else if (@hasField(@TypeOf(field), "default_value")) {
                             if (field.default_value) |default_val| {
                                 @field(result, field.name) = @as(*const field.type, @ptrCast(@alignCast(default_val))).*;
                             } else if (@typeInfo(field.type) == .Optional) {
@@ -177,73 +1069,373 @@ pub const Serde = struct {
             .pointer => |ptr| switch (ptr.size) {
                 .slice => {
                     if (ptr.child == u8) {
+                        if (decoder.options.float_as_decimal_string) {
+                            switch (try decoder.peekByte()) {
+                                0xf9, 0xfa, 0xfb => return decoder.decodeFloatText(),
+                                else => {},
+                            }
+                        }
                         return decoder.decodeBytes();
                     } else {
                         if ((try decoder.peekByte()) >> 5 != 4) return error.TypeMismatch;
-                        const array_len = try decoder.decodeArrayHeader();
-                        var list = try decoder.arena.allocator().alloc(ptr.child, array_len);
-                        for (0..array_len) |j| {
-                            list[j] = try self.deserializeValue(decoder, ptr.child);
+                        if (try decoder.decodeArrayHeader()) |array_len| {
+                            var list = try decoder.allocItems(ptr.child, array_len);
+                            for (0..array_len) |j| {
+                                list[j] = try self.deserializeValue(decoder, ptr.child);
+                            }
+                            return list;
+                        }
+                        var list: std.ArrayListUnmanaged(ptr.child) = .empty;
+                        while (try decoder.hasNext(null, 0)) {
+                            const item = try self.deserializeValue(decoder, ptr.child);
+                            list.append(decoder.allocator(), item) catch return decoder.allocError();
                         }
-                        return list;
+                        return list.toOwnedSlice(decoder.allocator()) catch return decoder.allocError();
+                    }
+                },
+                .one => {
+                    decoder.nodes += 1;
+                    if (decoder.options.max_nodes) |max_nodes| {
+                        if (decoder.nodes > max_nodes) return error.TooManyNodes;
                     }
+                    decoder.depth += 1;
+                    defer decoder.depth -= 1;
+                    if (decoder.depth > decoder.options.max_nesting_depth) return error.NestingDepthExceeded;
+                    const node = try decoder.alloc(ptr.child, 1);
+                    node[0] = try self.deserializeValue(decoder, ptr.child);
+                    return &node[0];
                 },
                 else => @compileError("Unsupported pointer type: " ++ @typeName(T)),
             },
+            .array => |arr| {
+                var result: T = undefined;
+                if (arr.child == u8) {
+                    const bytes = try decoder.decodeBytes();
+                    if (bytes.len != arr.len) return error.TypeMismatch;
+                    @memcpy(&result, bytes);
+                    return result;
+                }
+                const len = try decoder.decodeArrayHeader();
+                for (&result, 0..) |*item, j| {
+                    if (!try decoder.hasNext(len, j)) return error.TypeMismatch;
+                    item.* = try self.deserializeValue(decoder, arr.child);
+                }
+                if (try decoder.hasNext(len, arr.len)) return error.TypeMismatch;
+                return result;
+            },
+            .vector => |vec| {
+                var lanes: [vec.len]vec.child = undefined;
+                const len = try decoder.decodeArrayHeader();
+                for (&lanes, 0..) |*lane, j| {
+                    if (!try decoder.hasNext(len, j)) return error.TypeMismatch;
+                    lane.* = try self.deserializeValue(decoder, vec.child);
+                }
+                if (try decoder.hasNext(len, vec.len)) return error.TypeMismatch;
+                return lanes;
+            },
             .optional => |opt| {
-                if ((try decoder.peekByte()) == 0xf6) { // null
+                // For nested optionals a null belongs to the innermost level;
+                // the outer null is left to mean "absent".
+                if (@typeInfo(opt.child) != .optional and (try decoder.peekByte()) == 0xf6) { // null
                     _ = try decoder.readByte();
                     return null;
                 }
                 return try self.deserializeValue(decoder, opt.child);
             },
             .@"enum" => |enum_info| {
-                const name = try decoder.decodeString();
-                inline for (enum_info.fields) |field| {
-                    if (std.mem.eql(u8, name, field.name)) {
-                        return @as(T, @enumFromInt(field.value));
+                const major_type = (try decoder.peekByte()) >> 5;
+                if (major_type == 0 or major_type == 1) {
+                    const int_value = try self.deserializeValue(decoder, i128);
+                    inline for (enum_info.fields) |field| {
+                        if (int_value == field.value) return @as(T, @enumFromInt(field.value));
                     }
+                    return error.InvalidEnumTag;
                 }
-                return error.InvalidEnumTag;
+                const name = try decoder.decodeString();
+                const names = comptime enumNameMap(T);
+                return names.get(name) orelse error.InvalidEnumTag;
             },
             .@"union" => |union_info| {
-                if (union_info.tag_type == null) @compileError("Only tagged unions supported.");
-                if (try decoder.decodeArrayHeader() != 2) return error.InvalidUnionRepresentation;
-                const tag_name = try decoder.decodeString();
-                inline for (union_info.fields) |field| {
-                    if (std.mem.eql(u8, tag_name, field.name)) {
-                        const payload = try self.deserializeValue(decoder, field.type);
-                        return @unionInit(T, field.name, payload);
-                    }
+                if (comptime isNetAddress(T)) {
+                    const len = try decoder.decodeArrayHeader();
+                    if (len != null and len.? != 2) return error.TypeMismatch;
+                    const addr = try decoder.decodeBytes();
+                    const port = try self.deserializeValue(decoder, u16);
+                    if (try decoder.hasNext(len, 2)) return error.TypeMismatch;
+                    return switch (addr.len) {
+                        4 => std.net.Address.initIp4(addr[0..4].*, port),
+                        16 => std.net.Address.initIp6(addr[0..16].*, port, 0, 0),
+                        else => error.TypeMismatch,
+                    };
                 }
-                return error.InvalidEnumTag;
+                if (union_info.tag_type == null) @compileError("Only tagged unions supported.");
+                const format = unionFormat(T, decoder.options.union_format);
+                if (format == .untagged) return self.deserializeUntagged(decoder, T);
+                // One map entry or two array items, then a break if indefinite.
+                const len = if (format == .single_key_map) try decoder.decodeMapHeader() else try decoder.decodeArrayHeader();
+                const count: u64 = if (format == .single_key_map) 1 else 2;
+                if (len != null and len.? != count) return error.InvalidUnionRepresentation;
+                const result: T = switch (format) {
+                    .name_array, .single_key_map => blk: {
+                        const tag_name = try decoder.decodeString();
+                        inline for (union_info.fields) |field| {
+                            if (std.mem.eql(u8, tag_name, field.name)) {
+                                const payload = try self.deserializeValue(decoder, field.type);
+                                break :blk @unionInit(T, field.name, payload);
+                            }
+                        }
+                        return error.InvalidEnumTag;
+                    },
+                    .untagged => unreachable,
+                    .int_array => blk: {
+                        const discriminant = try self.deserializeValue(decoder, i128);
+                        inline for (union_info.fields) |field| {
+                            if (discriminant == @intFromEnum(@field(union_info.tag_type.?, field.name))) {
+                                const payload = try self.deserializeValue(decoder, field.type);
+                                break :blk @unionInit(T, field.name, payload);
+                            }
+                        }
+                        return error.InvalidEnumTag;
+                    },
+                };
+                if (try decoder.hasNext(len, count)) return error.InvalidUnionRepresentation;
+                return result;
             },
             .int => |_| {
+                if (decoder.options.parse_stringified_numbers and (try decoder.peekByte()) >> 5 == 3) {
+                    const text = try decoder.decodeString();
+                    return std.fmt.parseInt(T, text, 10) catch |err| switch (err) {
+                        error.Overflow => error.IntegerOutOfRange,
+                        error.InvalidCharacter => error.InvalidNumber,
+                    };
+                }
                 const head = try decoder.readByte();
+                if (head == 0xc2 or head == 0xc3) { // Tagged bignum
+                    const Magnitude = std.meta.Int(.unsigned, @max(128, @bitSizeOf(T)));
+                    const magnitude = try decoder.decodeBignum(Magnitude);
+                    if (head == 0xc3) {
+                        const Wide = std.meta.Int(.signed, @bitSizeOf(Magnitude) + 1);
+                        return std.math.cast(T, -1 - @as(Wide, magnitude)) orelse error.IntegerOutOfRange;
+                    }
+                    return std.math.cast(T, magnitude) orelse error.IntegerOutOfRange;
+                }
+                if (head >> 5 > 1) return error.TypeMismatch;
                 const val = try decoder.decodeUIntPayload(head & 0x1F);
                 if (head >> 5 == 1) { // Negative
-                    return std.math.cast(T, -1 - @as(i128, @intCast(val))) orelse error.IoError;
+                    return std.math.cast(T, -1 - @as(i128, val)) orelse error.IntegerOutOfRange;
                 }
-                return std.math.cast(T, val) orelse error.IoError;
+                return std.math.cast(T, val) orelse error.IntegerOutOfRange;
             },
             .float => |float_info| switch (float_info.bits) {
-                32 => return @as(T, @bitCast(try decoder.decodeFloat32Payload())),
-                64 => return @as(T, @bitCast(try decoder.decodeFloat64Payload())),
+                32, 64 => {
+                    if (decoder.options.parse_stringified_numbers and (try decoder.peekByte()) >> 5 == 3) {
+                        const text = try decoder.decodeString();
+                        return std.fmt.parseFloat(T, text) catch error.InvalidNumber;
+                    }
+                    return decoder.decodeFloatAs(T);
+                },
                 else => @compileError("Unsupported float size."),
             },
             .bool => return decoder.decodeBool(),
+            .error_union => |eu| {
+                const len = try decoder.decodeMapHeader();
+                if (len != null and len.? != 1) return error.InvalidUnionRepresentation;
+                const key = try decoder.decodeString();
+                const result: T = if (std.mem.eql(u8, key, "ok")) try self.deserializeValue(decoder, eu.payload) else blk: {
+                    if (!std.mem.eql(u8, key, "err")) return error.InvalidUnionRepresentation;
+                    // Names are matched ignoring case to accept `lowercase_error_names`.
+                    const name = try decoder.decodeString();
+                    if (@typeInfo(eu.error_set).error_set) |errors| {
+                        inline for (errors) |e| {
+                            if (std.ascii.eqlIgnoreCase(name, e.name)) break :blk @field(eu.error_set, e.name);
+                        }
+                    }
+                    return error.InvalidEnumTag;
+                };
+                if (try decoder.hasNext(len, 1)) return error.InvalidUnionRepresentation;
+                return result;
+            },
+            .void => {
+                if (try decoder.readByte() != 0xf6) return error.TypeMismatch;
+            },
             else => @compileError("Unsupported type for deserialization: " ++ @typeName(T)),
         };
     }
 
-    fn extractField(self: *Serde, bytes: []const u8, field_name: []const u8, comptime T: type) CborError!?T {
-        var decoder = Decoder.init(&self.arena, bytes, self.config);
+    // Decodes the entries of a struct map into the fields of `result`,
+    // recording each field written in `populated`.
+    fn deserializeFields(
+        self: *const Serde,
+        decoder: *Decoder,
+        comptime T: type,
+        result: *T,
+        map_len: ?u64,
+        pair_array: bool,
+        populated: *u64,
+    ) CborError!void {
+        const fields = std.meta.fields(T);
+        const extra_name = comptime extraFieldName(T);
+        const field_map = comptime fieldNameMap(T);
+        var i: u64 = 0;
+        while (try decoder.hasNext(map_len, i)) : (i += 1) {
+            if (pair_array) {
+                const pair_len = try decoder.decodeArrayHeader();
+                if (pair_len == null or pair_len.? != 2) return error.InvalidPairArray;
+            }
+            const key_head = try decoder.peekByte();
+            if (key_head == 0xff) return error.UnexpectedBreak;
+            const key_major = key_head >> 5;
+            if (@hasDecl(T, "cbor_keys") and (key_major == 0 or key_major == 1)) {
+                const int_key = try self.deserializeValue(decoder, i128);
+                var found_int_key = false;
+                inline for (fields, 0..) |field, field_idx| {
+                    if (comptime !isKeyedField(T, field.name)) continue;
+                    if (comptime fieldIntKey(T, field.name)) |field_key| {
+                        if (int_key == field_key) {
+                            try decoder.checkDuplicate(populated.*, field_idx);
+                            @field(result.*, field.name) = try self.deserializeValue(decoder, field.type);
+                            populated.* |= (@as(u64, 1) << @intCast(field_idx));
+                            found_int_key = true;
+                            break;
+                        }
+                    }
+                }
+                if (!found_int_key) try decoder.skipValue();
+                continue;
+            }
+
+            const key = try decoder.decodeString();
+            if (field_map.get(key)) |field_tag| switch (field_tag) {
+                inline else => |tag| if (comptime isKeyedField(T, @tagName(tag))) {
+                    const field_idx = comptime std.meta.fieldIndex(T, @tagName(tag)).?;
+                    try decoder.checkDuplicate(populated.*, field_idx);
+                    @field(result.*, @tagName(tag)) = try self.deserializeValue(decoder, @FieldType(T, @tagName(tag)));
+                    populated.* |= (@as(u64, 1) << @intCast(field_idx));
+                } else unreachable,
+            } else {
+                if (extra_name != null and !isSkippedKey(T, key)) {
+                    const V = @FieldType(@FieldType(T, extra_name.?).KV, "value");
+                    const value = try self.deserializeValue(decoder, V);
+                    @field(result.*, extra_name.?).put(key, value) catch return decoder.allocError();
+                } else {
+                    try decoder.skipValue();
+                }
+            }
+        }
+    }
+
+    pub fn PartialArray(comptime T: type) type {
+        return struct {
+            items: []T,
+            /// Number of elements in the whole array.
+            total: u64,
+        };
+    }
+
+    /// Decodes elements `start..start + count` of an array of `T`, skipping
+    /// the others. The window is cut short at the end of the array.
+    pub fn decodePartialArray(self: *Serde, bytes: []const u8, comptime T: type, start: u64, count: usize) CborError!PartialArray(T) {
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
+        const len = try decoder.decodeArrayHeader();
+        var items: std.ArrayListUnmanaged(T) = .empty;
+        if (len) |n| {
+            const window = @min(count, n -| start);
+            items.ensureTotalCapacityPrecise(decoder.allocator(), window) catch return decoder.allocError();
+        }
+
+        var i: u64 = 0;
+        while (try decoder.hasNext(len, i)) : (i += 1) {
+            if (i < start or items.items.len == count) {
+                try decoder.skipValue();
+                continue;
+            }
+            const item = try self.deserializeValue(&decoder, T);
+            items.append(decoder.allocator(), item) catch return decoder.allocError();
+        }
+        return .{ .items = items.items, .total = i };
+    }
+
+    /// Decodes an array of `T` into `out` and returns the number of elements
+    /// written. Fails with `error.CapacityExceeded` if the array is longer
+    /// than `out`. Nothing is allocated unless `T` itself needs it.
+    pub fn decodeSlice(self: *Serde, comptime T: type, bytes: []const u8, out: []T) CborError!usize {
+        if (self.config.decode.require_canonical) try validateCanonical(bytes);
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
+        const len = try decoder.decodeArrayHeader();
+        if (len) |n| {
+            if (n > out.len) return error.CapacityExceeded;
+        }
+        var i: usize = 0;
+        while (try decoder.hasNext(len, i)) : (i += 1) {
+            if (i == out.len) return error.CapacityExceeded;
+            out[i] = try self.deserializeValue(&decoder, T);
+        }
+        return i;
+    }
+
+    pub fn FieldItems(comptime T: type) type {
+        return std.enums.EnumArray(std.meta.FieldEnum(T), ?DataItem);
+    }
+
+    /// Decodes a map holding a `T` without converting the values, so callers
+    /// can see which fields are present (non-null) before a typed decode.
+    /// Keys that match no field of `T` are skipped.
+    pub fn decodeFields(self: *Serde, bytes: []const u8, comptime T: type) CborError!FieldItems(T) {
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
+        var items = FieldItems(T).initFill(null);
+        const field_map = comptime fieldNameMap(T);
+
+        const map_len = try decoder.decodeMapHeader();
+        var i: u64 = 0;
+        while (try decoder.hasNext(map_len, i)) : (i += 1) {
+            const key_major = (try decoder.peekByte()) >> 5;
+            const field_tag: ?std.meta.FieldEnum(T) = if (key_major == 0 or key_major == 1) blk: {
+                const int_key = try self.deserializeValue(&decoder, i128);
+                inline for (std.meta.fields(T)) |field| {
+                    if (comptime isKeyedField(T, field.name) and fieldIntKey(T, field.name) != null) {
+                        if (int_key == comptime fieldIntKey(T, field.name).?) break :blk @field(std.meta.FieldEnum(T), field.name);
+                    }
+                }
+                break :blk null;
+            } else field_map.get(try decoder.decodeString());
+
+            if (field_tag) |tag| {
+                items.set(tag, try decoder.decodeDataItem());
+            } else {
+                try decoder.skipValue();
+            }
+        }
+        return items;
+    }
+
+    /// Decodes a map into the struct at `ptr`, writing only the fields whose
+    /// keys are present and leaving the others as they were. Fields are
+    /// replaced whole, so nested structs are not merged. On error `ptr.*` is
+    /// left unchanged.
+    pub fn decodeInPlace(self: *Serde, ptr: anytype, bytes: []const u8) CborError!void {
+        const T = @typeInfo(@TypeOf(ptr)).pointer.child;
+        if (@typeInfo(T) != .@"struct") @compileError("decodeInPlace needs a pointer to a struct, got " ++ @typeName(@TypeOf(ptr)));
+        if (self.config.decode.require_canonical) try validateCanonical(bytes);
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
+        const major_type = (try decoder.peekByte()) >> 5;
+        const pair_array = major_type == 4 and decoder.options.accept_pair_arrays;
+        if (major_type != 5 and !pair_array) return error.TypeMismatch;
+        const map_len = if (pair_array) try decoder.decodeArrayHeader() else try decoder.decodeMapHeader();
+
+        var updated = ptr.*;
+        var populated: u64 = 0;
+        try self.deserializeFields(&decoder, T, &updated, map_len, pair_array, &populated);
+        ptr.* = updated;
+    }
+
+    fn extractField(self: *Serde, bytes: []const u8, field_name: []const u8, comptime T: type) CborError!?T {
+        var decoder = Decoder.init(&self.arena, bytes, self.config.decode);
 
         if ((try decoder.peekByte()) >> 5 != 5) return null;
         const map_len = try decoder.decodeMapHeader();
 
         var i: u64 = 0;
-        while (i < map_len) : (i += 1) {
+        while (try decoder.hasNext(map_len, i)) : (i += 1) {
             const key = try decoder.decodeString();
             if (std.mem.eql(u8, key, field_name)) {
                 return try self.deserializeValue(&decoder, T);
@@ -255,25 +1447,168 @@ pub const Serde = struct {
     }
 };
 
+/// Writes a CBOR sequence (RFC 8742): items back to back with no framing,
+/// sharing one buffer and the options of the Serde that created it. Read
+/// sequences back with `Serde.sequenceDecoder`.
+pub const SequenceEncoder = struct {
+    serde: *Serde,
+    encoder: Encoder,
+    /// Number of items written so far.
+    count: usize = 0,
+
+    pub fn write(self: *SequenceEncoder, value: anytype) CborError!void {
+        try self.serde.serializeValue(&self.encoder, value);
+        self.count += 1;
+    }
+
+    /// Returns the encoded sequence, which the caller owns.
+    pub fn finish(self: *SequenceEncoder) CborError![]u8 {
+        return self.serde.buffer.toOwnedSlice();
+    }
+};
+
 pub const Encoder = struct {
     writer: std.ArrayList(u8).Writer,
+    options: EncodeOptions = .{},
+
+    const EntrySpan = struct {
+        start: usize = 0,
+        key_end: usize = 0,
+        end: usize = 0,
+    };
+
+    // Tracks where each key/value pair of a map lands in the output so that
+    // deterministic mode can reorder them once the map is complete.
+    const MapEntries = struct {
+        encoder: *Encoder,
+        spans: ?[]EntrySpan,
+        index: usize = 0,
+
+        fn key(self: *MapEntries) void {
+            const spans = self.spans orelse return;
+            const pos = self.encoder.offset();
+            if (self.index > 0) spans[self.index - 1].end = pos;
+            spans[self.index].start = pos;
+        }
+
+        fn value(self: *MapEntries) void {
+            const spans = self.spans orelse return;
+            spans[self.index].key_end = self.encoder.offset();
+            self.index += 1;
+        }
+
+        fn finish(self: *MapEntries) CborError!void {
+            if (self.spans) |spans| {
+                defer self.discard();
+                if (spans.len > 0) {
+                    spans[spans.len - 1].end = self.encoder.offset();
+                    try self.encoder.sortEntries(spans);
+                }
+            }
+            try self.encoder.endContainer();
+        }
+
+        fn discard(self: *MapEntries) void {
+            if (self.spans) |spans| self.encoder.allocator().free(spans);
+            self.spans = null;
+        }
+    };
+
+    /// The bytes written so far. The slice is invalidated by further writes
+    /// and by `reset`.
+    pub fn finish(self: *Encoder) []const u8 {
+        return self.writer.context.items;
+    }
+
+    /// Drops everything written but keeps the buffer's capacity.
+    pub fn reset(self: *Encoder) void {
+        self.writer.context.clearRetainingCapacity();
+    }
+
+    fn allocator(self: *Encoder) Allocator {
+        return self.writer.context.allocator;
+    }
+
+    fn offset(self: *Encoder) usize {
+        return self.writer.context.items.len;
+    }
+
+    fn beginArray(self: *Encoder, len: usize) CborError!void {
+        if (self.options.indefinite_length) return self.writer.writeByte(0x9f);
+        try self.encodeArrayHeader(len);
+    }
+
+    fn beginMapHeader(self: *Encoder, len: usize) CborError!void {
+        if (self.options.indefinite_length) return self.writer.writeByte(0xbf);
+        try self.encodeMapHeader(len);
+    }
+
+    fn beginMap(self: *Encoder, len: usize) CborError!MapEntries {
+        try self.beginMapHeader(len);
+        const spans = if (self.options.keyOrder() != .none) try self.allocator().alloc(EntrySpan, len) else null;
+        return .{ .encoder = self, .spans = spans };
+    }
+
+    fn endContainer(self: *Encoder) CborError!void {
+        if (self.options.indefinite_length) try self.writer.writeByte(0xff);
+    }
+
+    // Rewrites the contiguous run of entries described by `spans` so that
+    // they appear in bytewise order of their encoded keys.
+    fn sortEntries(self: *Encoder, spans: []EntrySpan) CborError!void {
+        if (spans.len < 2) return;
+        const items = self.writer.context.items;
+        const region_start = spans[0].start;
+        const scratch = try self.allocator().dupe(u8, items[region_start..]);
+        defer self.allocator().free(scratch);
+
+        for (spans) |*span| {
+            span.start -= region_start;
+            span.key_end -= region_start;
+            span.end -= region_start;
+        }
+        switch (self.options.keyOrder()) {
+            .none => unreachable,
+            .bytewise => std.mem.sort(EntrySpan, spans, @as([]const u8, scratch), keyLessThan),
+            .length_first => std.mem.sort(EntrySpan, spans, @as([]const u8, scratch), keyLengthFirstLessThan),
+        }
+
+        var pos = region_start;
+        for (spans) |span| {
+            const entry = scratch[span.start..span.end];
+            @memcpy(items[pos..][0..entry.len], entry);
+            pos += entry.len;
+        }
+    }
+
+    // Shorter encodings of a common prefix sort first, so this is a total
+    // order; `std.mem.sort` is stable, so equal keys keep their input order.
+    fn keyLessThan(scratch: []const u8, a: EntrySpan, b: EntrySpan) bool {
+        return std.mem.lessThan(u8, scratch[a.start..a.key_end], scratch[b.start..b.key_end]);
+    }
+
+    fn keyLengthFirstLessThan(scratch: []const u8, a: EntrySpan, b: EntrySpan) bool {
+        const a_len = a.key_end - a.start;
+        const b_len = b.key_end - b.start;
+        if (a_len != b_len) return a_len < b_len;
+        return keyLessThan(scratch, a, b);
+    }
 
     fn encodeUInt(self: *Encoder, major_type: u8, len: u64) !void {
-        const mt = major_type << 5;
-        if (len < 24) {
-            try self.writer.writeByte(mt | @as(u5, @intCast(len)));
-        } else if (len <= std.math.maxInt(u8)) {
-            try self.writer.writeByte(mt | 24);
-            try self.writer.writeInt(u8, @as(u8, @intCast(len)), .big);
-        } else if (len <= std.math.maxInt(u16)) {
-            try self.writer.writeByte(mt | 25);
-            try self.writer.writeInt(u16, @as(u16, @intCast(len)), .big);
-        } else if (len <= std.math.maxInt(u32)) {
-            try self.writer.writeByte(mt | 26);
-            try self.writer.writeInt(u32, @as(u32, @intCast(len)), .big);
-        } else {
-            try self.writer.writeByte(mt | 27);
-            try self.writer.writeInt(u64, len, .big);
+        try encodeHead(self.writer, @intCast(major_type), len);
+    }
+
+    // Tag 2 (or 3 when `negative`) over the big-endian magnitude without
+    // leading zero bytes.
+    fn encodeBignum(self: *Encoder, negative: bool, magnitude: anytype) !void {
+        const bits = @bitSizeOf(@TypeOf(magnitude));
+        const len = (bits - @clz(magnitude) + 7) / 8;
+        try self.encodeUInt(6, if (negative) 3 else 2);
+        try self.encodeUInt(2, len);
+        var i: usize = len;
+        while (i > 0) {
+            i -= 1;
+            try self.writer.writeByte(@truncate(magnitude >> @intCast(i * 8)));
         }
     }
 
@@ -287,6 +1622,36 @@ pub const Encoder = struct {
         try self.writer.writeAll(string);
     }
 
+    /// Writes `items` as an array of text strings.
+    pub fn encodeStringArray(self: *Encoder, items: []const []const u8) !void {
+        try self.beginArray(items.len);
+        for (items) |item| try self.encodeString(item);
+        try self.endContainer();
+    }
+
+    /// Starts an indefinite-length byte string; write chunks with
+    /// `encodeBytes` and close it with `encodeBreak`.
+    pub fn beginIndefiniteBytes(self: *Encoder) !void {
+        try self.writer.writeByte(0x5f);
+    }
+
+    /// Starts an indefinite-length text string made of `encodeString` chunks.
+    pub fn beginIndefiniteString(self: *Encoder) !void {
+        try self.writer.writeByte(0x7f);
+    }
+
+    pub fn beginIndefiniteArray(self: *Encoder) !void {
+        try self.writer.writeByte(0x9f);
+    }
+
+    pub fn beginIndefiniteMap(self: *Encoder) !void {
+        try self.writer.writeByte(0xbf);
+    }
+
+    pub fn encodeBreak(self: *Encoder) !void {
+        try self.writer.writeByte(0xff);
+    }
+
     pub fn encodeArrayHeader(self: *Encoder, len: usize) !void {
         try self.encodeUInt(4, @intCast(len));
     }
@@ -303,6 +1668,15 @@ pub const Encoder = struct {
         try self.writer.writeByte(0xf6);
     }
 
+    pub fn encodeUndefined(self: *Encoder) !void {
+        try self.writer.writeByte(0xf7);
+    }
+
+    pub fn encodeFloat16(self: *Encoder, value: f16) !void {
+        try self.writer.writeByte(0xf9);
+        try self.writer.writeInt(u16, @bitCast(value), .big);
+    }
+
     pub fn encodeFloat32(self: *Encoder, value: f32) !void {
         try self.writer.writeByte(0xfa);
         try self.writer.writeInt(u32, @bitCast(value), .big);
@@ -312,23 +1686,218 @@ pub const Encoder = struct {
         try self.writer.writeByte(0xfb);
         try self.writer.writeInt(u64, @bitCast(value), .big);
     }
+
+    /// Deterministic encoders use the shortest of f16, f32 and f64 that holds
+    /// `value` exactly, and write NaN as the f16 quiet NaN.
+    pub fn encodeFloat(self: *Encoder, value: f64) !void {
+        if (self.options.deterministic) {
+            if (std.math.isNan(value)) return self.encodeFloat16(std.math.nan(f16));
+            const half: f16 = @floatCast(value);
+            if (@as(f64, half) == value) return self.encodeFloat16(half);
+            const narrow: f32 = @floatCast(value);
+            if (@as(f64, narrow) == value) return self.encodeFloat32(narrow);
+        }
+        try self.encodeFloat64(value);
+    }
+
+    /// Writes a wall-clock time in nanoseconds since the Unix epoch (as from
+    /// `std.time.nanoTimestamp`) as a tag 1 timestamp: integer seconds when
+    /// whole, float seconds otherwise.
+    pub fn encodeEpochNanos(self: *Encoder, nanos: i128) CborError!void {
+        const seconds = @divFloor(nanos, std.time.ns_per_s);
+        if (@mod(nanos, std.time.ns_per_s) != 0) {
+            try self.encodeUInt(6, 1);
+            return self.encodeFloat(@as(f64, @floatFromInt(nanos)) / std.time.ns_per_s);
+        }
+        if (seconds < -(1 << 64) or seconds >= (1 << 64)) return error.IntegerOutOfRange;
+        try self.encodeUInt(6, 1);
+        if (seconds < 0) {
+            try self.encodeUInt(1, @intCast(-(seconds + 1)));
+        } else {
+            try self.encodeUInt(0, @intCast(seconds));
+        }
+    }
+
+    /// Writes the time elapsed from `start` to `now` as a plain integer of
+    /// nanoseconds. Monotonic `std.time.Instant` readings have no fixed
+    /// epoch, so they can't be written as tag 1 timestamps.
+    pub fn encodeElapsedNanos(self: *Encoder, now: std.time.Instant, start: std.time.Instant) !void {
+        try self.encodeUInt(0, now.since(start));
+    }
+
+    pub fn encodeErrorName(self: *Encoder, err: anyerror) !void {
+        const name = @errorName(err);
+        if (!self.options.lowercase_error_names) return self.encodeString(name);
+        try self.encodeUInt(3, name.len);
+        for (name) |c| try self.writer.writeByte(std.ascii.toLower(c));
+    }
+
+    /// Appends an already-encoded data item verbatim. Debug builds check that
+    /// `bytes` is exactly one well-formed item.
+    pub fn writeRaw(self: *Encoder, bytes: []const u8) CborError!void {
+        if (builtin.mode == .Debug) try validate(bytes);
+        try self.writer.writeAll(bytes);
+    }
+
+    /// Objects keep their key order unless the encoder is deterministic.
+    pub fn encodeJsonValue(self: *Encoder, value: std.json.Value) CborError!void {
+        switch (value) {
+            .null => try self.encodeNull(),
+            .bool => |v| try self.encodeBool(v),
+            .integer => |v| {
+                if (v < 0) {
+                    try self.encodeUInt(1, @intCast(-(v + 1)));
+                } else {
+                    try self.encodeUInt(0, @intCast(v));
+                }
+            },
+            .float => |v| try self.encodeFloat(v),
+            .number_string => |text| {
+                if (std.fmt.parseInt(i65, text, 10)) |v| {
+                    if (v < 0) return self.encodeUInt(1, @intCast(-(v + 1)));
+                    return self.encodeUInt(0, @intCast(v));
+                } else |_| {}
+                const v = std.fmt.parseFloat(f64, text) catch return error.InvalidJson;
+                try self.encodeFloat(v);
+            },
+            .string => |v| try self.encodeString(v),
+            .array => |list| {
+                try self.beginArray(list.items.len);
+                for (list.items) |child| try self.encodeJsonValue(child);
+                try self.endContainer();
+            },
+            .object => |object| {
+                var entries = try self.beginMap(object.count());
+                errdefer entries.discard();
+                var it = object.iterator();
+                while (it.next()) |entry| {
+                    entries.key();
+                    try self.encodeString(entry.key_ptr.*);
+                    entries.value();
+                    try self.encodeJsonValue(entry.value_ptr.*);
+                }
+                try entries.finish();
+            },
+        }
+    }
+
+    pub fn encodeDataItem(self: *Encoder, item: DataItem) CborError!void {
+        switch (item) {
+            .uint => |v| try self.encodeUInt(0, v),
+            .nint => |v| try self.encodeUInt(1, v),
+            .bytes => |v| try self.encodeBytes(v),
+            .text => |v| try self.encodeString(v),
+            .array => |items| {
+                try self.beginArray(items.len);
+                for (items) |child| try self.encodeDataItem(child);
+                try self.endContainer();
+            },
+            .map => |pairs| {
+                var entries = try self.beginMap(pairs.len);
+                errdefer entries.discard();
+                for (pairs) |pair| {
+                    entries.key();
+                    try self.encodeDataItem(pair.key);
+                    entries.value();
+                    try self.encodeDataItem(pair.value);
+                }
+                try entries.finish();
+            },
+            .tag => |tag| {
+                try self.encodeUInt(6, tag.number);
+                try self.encodeDataItem(tag.content.*);
+            },
+            .float => |float| {
+                if (self.options.deterministic) return self.encodeFloat(float.value);
+                switch (float.width) {
+                    .f16 => try self.encodeFloat16(@floatCast(float.value)),
+                    .f32 => try self.encodeFloat32(@floatCast(float.value)),
+                    .f64 => try self.encodeFloat64(float.value),
+                }
+            },
+            .bool => |v| try self.encodeBool(v),
+            .null => try self.encodeNull(),
+            .undefined => try self.encodeUndefined(),
+            .simple => |v| {
+                if (v < 24) {
+                    try self.writer.writeByte(0xe0 | v);
+                } else {
+                    try self.writer.writeByte(0xf8);
+                    try self.writer.writeByte(v);
+                }
+            },
+        }
+    }
 };
 
 pub const Decoder = struct {
     stream: std.io.FixedBufferStream([]const u8),
     arena: *std.heap.ArenaAllocator,
-    config: Config,
+    options: DecodeOptions,
     depth: u32,
+    budget: BudgetAllocator,
+    nodes: usize = 0,
+    /// When set, string payloads are allocated here, outside the budget.
+    strings: ?Allocator = null,
+    /// When set, replaces the arena for everything other than strings.
+    containers: ?Allocator = null,
 
-    pub fn init(arena: *std.heap.ArenaAllocator, bytes: []const u8, config: Config) Decoder {
+    pub fn init(arena: *std.heap.ArenaAllocator, bytes: []const u8, options: DecodeOptions) Decoder {
         return .{
             .stream = std.io.fixedBufferStream(bytes),
             .arena = arena,
-            .config = config,
+            .options = options,
             .depth = 0,
+            .budget = .{
+                .child = arena.allocator(),
+                .remaining = options.max_total_alloc orelse std.math.maxInt(usize),
+            },
         };
     }
 
+    /// Position of the next unread byte. After `error.UnexpectedBreak` this
+    /// is the offset of the stray break.
+    pub fn offset(self: *const Decoder) usize {
+        return self.stream.pos;
+    }
+
+    pub fn remaining(self: *const Decoder) usize {
+        return self.stream.buffer.len - self.stream.pos;
+    }
+
+    /// Moves to `pos`, typically a value previously returned by `offset`.
+    pub fn seek(self: *Decoder, pos: usize) CborError!void {
+        if (pos > self.stream.buffer.len) return error.EndOfStream;
+        self.stream.pos = pos;
+    }
+
+    fn allocator(self: *Decoder) Allocator {
+        return self.budget.allocator();
+    }
+
+    // For values that keep their allocator after decoding, such as hash maps.
+    // Their storage is charged to the budget while decoding, then handed to
+    // this allocator, which owns the same memory but outlives the decoder.
+    fn persistentAllocator(self: *Decoder) Allocator {
+        return self.containers orelse self.arena.allocator();
+    }
+
+    fn allocString(self: *Decoder, len: u64) CborError![]u8 {
+        const strings = self.strings orelse return self.allocItems(u8, len);
+        const n = try lengthAs(usize, len);
+        if (n > self.options.max_allocation_size) return error.AllocationTooLarge;
+        return strings.alloc(u8, n) catch error.OutOfMemory;
+    }
+
+    fn alloc(self: *Decoder, comptime T: type, n: usize) CborError![]T {
+        return self.allocator().alloc(T, n) catch return self.allocError();
+    }
+
+    fn allocError(self: *Decoder) CborError {
+        if (self.budget.exceeded) return error.AllocationBudgetExceeded;
+        return error.OutOfMemory;
+    }
+
     fn readByte(self: *Decoder) !u8 {
         return self.stream.reader().readByte();
     }
@@ -340,348 +1909,4902 @@ pub const Decoder = struct {
     }
 
     fn decodeUIntPayload(self: *Decoder, add_info: u8) CborError!u64 {
-        return switch (add_info) {
-            0...23 => @intCast(add_info),
-            24 => try self.stream.reader().readInt(u8, .big),
-            25 => try self.stream.reader().readInt(u16, .big),
-            26 => try self.stream.reader().readInt(u32, .big),
-            27 => try self.stream.reader().readInt(u64, .big),
-            else => error.InvalidAdditionalInfo,
-        };
+        const head_offset = self.stream.pos - 1;
+        const arg = try readArgument(self.stream.reader(), add_info);
+        if (self.options.on_non_minimal) |callback| {
+            if (!isMinimalArgument(add_info, arg)) callback.func(callback.context, head_offset);
+        }
+        return arg;
+    }
+
+    // Container lengths are null for indefinite-length items; iterate them
+    // with `hasNext`.
+    fn decodeContainerLen(self: *Decoder, add_info: u8) CborError!?u64 {
+        if (add_info == 31) return null;
+        return try self.decodeUIntPayload(add_info);
     }
 
-    fn decodeArrayHeader(self: *Decoder) !u64 {
+    fn decodeArrayHeader(self: *Decoder) !?u64 {
         const head = try self.readByte();
         if (head >> 5 != 4) return error.TypeMismatch;
-        return self.decodeUIntPayload(head & 0x1F);
+        return self.decodeContainerLen(head & 0x1F);
     }
 
-    fn decodeMapHeader(self: *Decoder) !u64 {
+    fn decodeMapHeader(self: *Decoder) !?u64 {
         const head = try self.readByte();
         if (head >> 5 != 5) return error.TypeMismatch;
-        return self.decodeUIntPayload(head & 0x1F);
+        return self.decodeContainerLen(head & 0x1F);
+    }
+
+    // Reports whether element `index` of a container exists, consuming the
+    // break byte that terminates an indefinite-length container.
+    fn hasNext(self: *Decoder, len: ?u64, index: u64) CborError!bool {
+        if (len) |n| return index < n;
+        if ((try self.peekByte()) != 0xff) return true;
+        _ = try self.readByte();
+        return false;
     }
 
     fn decodeBytes(self: *Decoder) ![]u8 {
         const head = try self.readByte();
         const major_type = head >> 5;
         if (major_type != 2 and major_type != 3) return error.TypeMismatch;
-        const len = try self.decodeUIntPayload(head & 0x1F);
-        if (len > self.config.max_allocation_size) return error.AllocationTooLarge;
-        const bytes = try self.arena.allocator().alloc(u8, @intCast(len));
-        try self.stream.reader().readNoEof(bytes);
+        const bytes = try self.readStringPayload(major_type, head & 0x1F);
+        if (major_type == 3) try checkUtf8(bytes);
+        return bytes;
+    }
+
+    // Reads the head of the next chunk of an indefinite-length string and
+    // returns its length, or null at the closing break. `chunks` counts the
+    // chunks read so far against `max_string_chunks`.
+    fn nextChunk(self: *Decoder, major_type: u8, chunks: *usize) CborError!?u64 {
+        const chunk = try self.readByte();
+        if (chunk == 0xff) return null;
+        if (chunk >> 5 != major_type or chunk & 0x1F == 31) return error.InvalidStringChunk;
+        chunks.* += 1;
+        if (chunks.* > self.options.max_string_chunks) return error.TooManyStringChunks;
+        return try self.decodeUIntPayload(chunk & 0x1F);
+    }
+
+    // Reads the content of a byte or text string whose head has been read.
+    // Indefinite-length strings are joined from their chunks, which are
+    // located first so that the result is allocated once.
+    fn readStringPayload(self: *Decoder, major_type: u8, add_info: u8) CborError![]u8 {
+        if (add_info != 31) {
+            const bytes = try self.allocString(try self.decodeUIntPayload(add_info));
+            try self.stream.reader().readNoEof(bytes);
+            return bytes;
+        }
+        const start = self.stream.pos;
+        var total: u64 = 0;
+        var chunks: usize = 0;
+        while (try self.nextChunk(major_type, &chunks)) |len| {
+            if (len > self.stream.buffer.len - self.stream.pos) return error.EndOfStream;
+            self.stream.pos += @intCast(len);
+            total += len;
+        }
+        const bytes = try self.allocString(total);
+        // The chunk heads are known to be good now.
+        self.stream.pos = start;
+        var filled: usize = 0;
+        while (true) {
+            const chunk = try self.readByte();
+            if (chunk == 0xff) break;
+            const len: usize = @intCast(try readArgument(self.stream.reader(), chunk & 0x1F));
+            try self.stream.reader().readNoEof(bytes[filled..][0..len]);
+            filled += len;
+        }
         return bytes;
     }
 
     fn decodeString(self: *Decoder) ![]u8 {
         const head = try self.readByte();
-        if (head >> 5 != 3) return error.TypeMismatch;
-        const len = try self.decodeUIntPayload(head & 0x1F);
-        if (len > self.config.max_allocation_size) return error.AllocationTooLarge;
-        const bytes = try self.arena.allocator().alloc(u8, @intCast(len));
-        try self.stream.reader().readNoEof(bytes);
+        if (head >> 5 != 3 and !(head >> 5 == 2 and self.options.bytes_as_text)) return error.TypeMismatch;
+        const bytes = try self.readStringPayload(head >> 5, head & 0x1F);
+        try checkUtf8(bytes);
         return bytes;
     }
 
+    // Reads a byte or text string into `buf` without allocating and returns
+    // its length. The chunks of an indefinite-length string are joined.
+    fn decodeBytesInto(self: *Decoder, buf: []u8) CborError!usize {
+        const head = try self.readByte();
+        const major_type = head >> 5;
+        if (major_type != 2 and major_type != 3) return error.TypeMismatch;
+        var filled: usize = 0;
+        if (head & 0x1F == 31) {
+            var chunks: usize = 0;
+            while (try self.nextChunk(major_type, &chunks)) |len| {
+                if (len > buf.len - filled) return error.CapacityExceeded;
+                try self.stream.reader().readNoEof(buf[filled..][0..@intCast(len)]);
+                filled += @intCast(len);
+            }
+        } else {
+            const len = try self.decodeUIntPayload(head & 0x1F);
+            if (len > buf.len) return error.CapacityExceeded;
+            filled = @intCast(len);
+            try self.stream.reader().readNoEof(buf[0..filled]);
+        }
+        if (major_type == 3) try checkUtf8(buf[0..filled]);
+        return filled;
+    }
+
+    fn decodeSimple(self: *Decoder) CborError!u8 {
+        const head = try self.readByte();
+        if (head >> 5 != 7) return error.TypeMismatch;
+        return switch (head & 0x1F) {
+            0...23 => |v| v,
+            24 => blk: {
+                const v = try self.readByte();
+                if (v < 32) return error.InvalidAdditionalInfo;
+                break :blk v;
+            },
+            else => error.TypeMismatch,
+        };
+    }
+
+    // Reads the byte string content of a tag 2/3 bignum. Leading zero bytes
+    // are skipped, as long as the value fits in `Magnitude`.
+    fn decodeBignum(self: *Decoder, comptime Magnitude: type) CborError!Magnitude {
+        const head = try self.readByte();
+        if (head >> 5 != 2 or head & 0x1F == 31) return error.TypeMismatch;
+        const len = try self.decodeUIntPayload(head & 0x1F);
+        if (len > self.stream.buffer.len - self.stream.pos) return error.EndOfStream;
+        var magnitude: Magnitude = 0;
+        for (0..@intCast(len)) |_| {
+            if (magnitude >> (@bitSizeOf(Magnitude) - 8) != 0) return error.IntegerOutOfRange;
+            magnitude = (magnitude << 8) | try self.readByte();
+        }
+        return magnitude;
+    }
+
     fn decodeBool(self: *Decoder) !bool {
         return switch (try self.readByte()) {
             0xf4 => false,
             0xf5 => true,
+            0x00 => if (self.options.int_bools) false else error.TypeMismatch,
+            0x01 => if (self.options.int_bools) true else error.TypeMismatch,
             else => error.TypeMismatch,
         };
     }
 
-    fn decodeFloat32Payload(self: *Decoder) !u32 {
-        if (try self.readByte() != 0xfa) return error.TypeMismatch;
-        return self.stream.reader().readInt(u32, .big);
+    fn decodeFloatText(self: *Decoder) CborError![]u8 {
+        const head = try self.peekByte();
+        const value = try self.decodeFloat();
+        var buf: [512]u8 = undefined;
+        const text = switch (head) {
+            0xf9 => std.fmt.bufPrint(&buf, "{d}", .{@as(f16, @floatCast(value))}),
+            0xfa => std.fmt.bufPrint(&buf, "{d}", .{@as(f32, @floatCast(value))}),
+            else => std.fmt.bufPrint(&buf, "{d}", .{value}),
+        } catch unreachable;
+        const result = try self.allocString(text.len);
+        @memcpy(result, text);
+        return result;
     }
 
-    fn decodeFloat64Payload(self: *Decoder) !u64 {
-        if (try self.readByte() != 0xfb) return error.TypeMismatch;
-        return self.stream.reader().readInt(u64, .big);
+    fn decodeFloat(self: *Decoder) !f64 {
+        const reader = self.stream.reader();
+        return switch (try self.readByte()) {
+            0xf9 => @as(f16, @bitCast(try reader.readInt(u16, .big))),
+            0xfa => @as(f32, @bitCast(try reader.readInt(u32, .big))),
+            0xfb => @bitCast(try reader.readInt(u64, .big)),
+            else => error.TypeMismatch,
+        };
     }
 
-    fn skipValue(self: *Decoder) !void {
+    // Decodes a float of any width into `T`. Narrower floats widen freely; a
+    // wider one must come through the narrowing unchanged (or be NaN).
+    fn decodeFloatAs(self: *Decoder, comptime T: type) CborError!T {
+        const value = try self.decodeFloat();
+        const narrow: T = @floatCast(value);
+        if (@as(f64, narrow) != value and !std.math.isNan(value)) return error.TypeMismatch;
+        return narrow;
+    }
+
+    fn checkDuplicate(self: *Decoder, populated_fields: u64, field_idx: usize) CborError!void {
+        if (!self.options.reject_duplicate_keys) return;
+        if (populated_fields & (@as(u64, 1) << @intCast(field_idx)) != 0) return error.DuplicateKey;
+    }
+
+    // Skips one item and returns a copy of its encoded bytes.
+    fn captureRaw(self: *Decoder) CborError![]u8 {
+        const start = self.stream.pos;
+        try self.skipValue();
+        const raw = self.stream.buffer[start..self.stream.pos];
+        const copy = try self.allocItems(u8, raw.len);
+        @memcpy(copy, raw);
+        return copy;
+    }
+
+    fn allocItems(self: *Decoder, comptime T: type, len: u64) CborError![]T {
+        const n = try lengthAs(usize, len);
+        if (n > self.options.max_allocation_size / @sizeOf(T)) return error.AllocationTooLarge;
+        return self.alloc(T, n);
+    }
+
+    fn decodeDataItem(self: *Decoder) CborError!DataItem {
         self.depth += 1;
-        if (self.depth > self.config.max_nesting_depth) return error.NestingDepthExceeded;
         defer self.depth -= 1;
+        if (self.depth > self.options.max_nesting_depth) return error.NestingDepthExceeded;
+
         const head = try self.readByte();
-        const major_type = head >> 5;
         const add_info = head & 0x1F;
-        switch (major_type) {
-            0, 1 => _ = try self.decodeUIntPayload(add_info),
+        switch (head >> 5) {
+            0 => return .{ .uint = try self.decodeUIntPayload(add_info) },
+            1 => return .{ .nint = try self.decodeUIntPayload(add_info) },
             2, 3 => {
-                const len = try self.decodeUIntPayload(add_info);
-                try self.stream.reader().skipBytes(@intCast(len), .{});
+                const bytes = try self.readStringPayload(head >> 5, add_info);
+                if (head >> 5 == 2) return .{ .bytes = bytes };
+                try checkUtf8(bytes);
+                return .{ .text = bytes };
             },
             4 => {
-                const len = try self.decodeUIntPayload(add_info);
-                var i: u64 = 0;
-                while (i < len) : (i += 1) try self.skipValue();
+                if (try self.decodeContainerLen(add_info)) |len| {
+                    const items = try self.allocItems(DataItem, len);
+                    for (items) |*item| item.* = try self.decodeDataItem();
+                    return .{ .array = items };
+                }
+                var items: std.ArrayListUnmanaged(DataItem) = .empty;
+                while (try self.hasNext(null, 0)) {
+                    const item = try self.decodeDataItem();
+                    items.append(self.allocator(), item) catch return self.allocError();
+                }
+                return .{ .array = items.toOwnedSlice(self.allocator()) catch return self.allocError() };
             },
             5 => {
-                const len = try self.decodeUIntPayload(add_info);
-                var i: u64 = 0;
-                while (i < len) : (i += 1) {
-                    try self.skipValue();
-                    try self.skipValue();
+                if (try self.decodeContainerLen(add_info)) |len| {
+                    const pairs = try self.allocItems(DataItem.Pair, len);
+                    for (pairs) |*pair| {
+                        pair.key = try self.decodeDataItem();
+                        pair.value = try self.decodeDataItem();
+                    }
+                    return .{ .map = pairs };
                 }
+                var pairs: std.ArrayListUnmanaged(DataItem.Pair) = .empty;
+                while (try self.hasNext(null, 0)) {
+                    const key = try self.decodeDataItem();
+                    const value = try self.decodeDataItem();
+                    pairs.append(self.allocator(), .{ .key = key, .value = value }) catch return self.allocError();
+                }
+                return .{ .map = pairs.toOwnedSlice(self.allocator()) catch return self.allocError() };
             },
-            6 => try self.skipValue(),
-            7 => switch (add_info) {
-                24 => try self.stream.reader().skipBytes(1, .{}),
-                25 => try self.stream.reader().skipBytes(2, .{}),
-                26 => try self.stream.reader().skipBytes(4, .{}),
-                27 => try self.stream.reader().skipBytes(8, .{}),
-                else => {},
+            6 => {
+                const number = try self.decodeUIntPayload(add_info);
+                const content = try self.allocItems(DataItem, 1);
+                content[0] = try self.decodeDataItem();
+                return .{ .tag = .{ .number = number, .content = &content[0] } };
+            },
+            7 => return switch (add_info) {
+                0...19 => .{ .simple = add_info },
+                20 => .{ .bool = false },
+                21 => .{ .bool = true },
+                22 => .null,
+                23 => .undefined,
+                24 => {
+                    const value = try self.readByte();
+                    if (value < 32) return error.InvalidAdditionalInfo;
+                    return .{ .simple = value };
+                },
+                25 => .{ .float = .{
+                    .value = @as(f16, @bitCast(try self.stream.reader().readInt(u16, .big))),
+                    .width = .f16,
+                } },
+                26 => .{ .float = .{
+                    .value = @as(f32, @bitCast(try self.stream.reader().readInt(u32, .big))),
+                    .width = .f32,
+                } },
+                27 => .{ .float = .{ .value = @bitCast(try self.stream.reader().readInt(u64, .big)) } },
+                31 => {
+                    // Leave `offset` at the break for the caller to report.
+                    self.stream.pos -= 1;
+                    return error.UnexpectedBreak;
+                },
+                else => error.InvalidAdditionalInfo,
             },
-            else => @panic("unreachable"),
+            else => unreachable,
         }
     }
+
+    fn skipValue(self: *Decoder) !void {
+        var walker = Walker{ .stream = &self.stream, .on_non_minimal = self.options.on_non_minimal };
+        return walker.skip(self.options.max_nesting_depth -| self.depth);
+    }
 };
 
-test "deserialize request with missing optional field" {
-    const allocator = std.testing.allocator;
-    const Operation = enum { create };
-    const OpsTarget = enum { document, index };
-    const Ops = union(OpsTarget) { document: Operation, index: Operation };
-    const MyRequest = struct {
-        operation: Ops,
-        space: ?[]const u8 = null,
-    };
-    var serde = Serde.init(allocator, .{});
+/// Encodes `value` with `options`; the caller owns the returned bytes.
+/// Passing `.{}` gives the same output as `Serde.serialize` with a default
+/// configuration.
+pub fn encodeWithOptions(allocator: Allocator, value: anytype, options: EncodeOptions) CborError![]u8 {
+    var serde = Serde.init(allocator, .{ .encode = options });
     defer serde.deinit();
-    const cbor_bytes = &.{ 0xa1, 0x69, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x82, 0x68, 0x64, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x66, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65 };
-
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
-    const req = try serde.deserialize(cbor_bytes, MyRequest);
+    return serde.serialize(value);
+}
 
-    try std.testing.expect(req.operation.document == .create);
-    try std.testing.expect(req.space == null);
+// Runs the `Serde` recursion over `decoder` for the free-standing decode
+// functions. The recursion reads its options from `decoder` and allocates
+// through it; the `Serde` only supplies the methods.
+fn decodeValue(decoder: *Decoder, comptime T: type) CborError!T {
+    var serde = Serde.init(decoder.arena.child_allocator, .{ .decode = decoder.options });
+    defer serde.deinit();
+    return serde.deserializeValue(decoder, T);
 }
 
-test "deserialize fails on missing required field" {
+/// Decodes a `T` from `bytes` with `options`. The result and everything it
+/// points to live in the returned arena.
+pub fn decodeWithOptions(allocator: Allocator, comptime T: type, bytes: []const u8, options: DecodeOptions) CborError!Decoded(T) {
+    const arena = try allocator.create(std.heap.ArenaAllocator);
+    errdefer allocator.destroy(arena);
+    arena.* = std.heap.ArenaAllocator.init(allocator);
+    errdefer arena.deinit();
+
+    if (bytes.len == 0 and options.empty_as_null) {
+        return .{ .arena = arena, .value = emptyValue(T) };
+    }
+    if (options.require_canonical) try validateCanonical(bytes);
+    var decoder = Decoder.init(arena, bytes, options);
+    return .{ .arena = arena, .value = try decodeValue(&decoder, T) };
+}
+
+/// Serializes `value` with the default configuration and returns the
+/// encoding as lowercase hex.
+pub fn encodeToHex(allocator: Allocator, value: anytype) CborError![]u8 {
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const bytes = try serde.serialize(value);
+    defer allocator.free(bytes);
+    return std.fmt.allocPrint(allocator, "{}", .{std.fmt.fmtSliceHexLower(bytes)});
+}
+
+/// A decoded value together with the arena that owns its memory.
+pub fn Decoded(comptime T: type) type {
+    return struct {
+        arena: *std.heap.ArenaAllocator,
+        value: T,
+
+        pub fn deinit(self: @This()) void {
+            const child = self.arena.child_allocator;
+            self.arena.deinit();
+            child.destroy(self.arena);
+        }
+    };
+}
+
+/// Decodes a `T` from hex-encoded CBOR using the default configuration.
+pub fn decodeFromHex(allocator: Allocator, comptime T: type, hex: []const u8) CborError!Decoded(T) {
+    if (hex.len % 2 != 0) return error.InvalidHex;
+    const bytes = try allocator.alloc(u8, hex.len / 2);
+    defer allocator.free(bytes);
+    _ = std.fmt.hexToBytes(bytes, hex) catch return error.InvalidHex;
+
+    const arena = try allocator.create(std.heap.ArenaAllocator);
+    errdefer allocator.destroy(arena);
+    arena.* = std.heap.ArenaAllocator.init(allocator);
+    errdefer arena.deinit();
+
+    var decoder = Decoder.init(arena, bytes, .{});
+    return .{ .arena = arena, .value = try decodeValue(&decoder, T) };
+}
+
+pub const Allocators = struct {
+    /// Byte and text string payloads.
+    strings: Allocator,
+    /// Slices, pointers, hash maps and everything else.
+    containers: Allocator,
+};
+
+/// Decodes a `T` with string payloads taken from `allocators.strings` and
+/// all other memory from `allocators.containers`, e.g. to pool strings
+/// separately. Nothing is freed individually, including after an error, so
+/// both are best arenas.
+pub fn decodeWithAllocators(allocators: Allocators, comptime T: type, bytes: []const u8, options: DecodeOptions) CborError!T {
+    if (options.require_canonical) try validateCanonical(bytes);
+    // Every allocation is routed to `allocators`; the arena stays empty.
+    var unused = std.heap.ArenaAllocator.init(allocators.containers);
+    defer unused.deinit();
+    var decoder = Decoder.init(&unused, bytes, options);
+    decoder.budget.child = allocators.containers;
+    decoder.strings = allocators.strings;
+    decoder.containers = allocators.containers;
+    return decodeValue(&decoder, T);
+}
+
+/// Changes that turn one document into another; see `diff` and `apply`.
+pub const Patch = struct {
+    changes: []const Change,
+
+    pub const Change = struct {
+        op: Op,
+        /// The map key, or for arrays the element index as `.uint`.
+        key: DataItem,
+        /// The new value; unused for `.remove`.
+        value: DataItem = .null,
+    };
+
+    pub const Op = enum { add, remove, change };
+};
+
+/// Compares two encoded documents whose top-level items are both maps or
+/// both arrays. Map entries are matched by key and arrays element by element;
+/// a nested value that differs is replaced whole. Array removals are listed
+/// from the highest index down, so changes apply in order.
+pub fn diff(allocator: Allocator, a_bytes: []const u8, b_bytes: []const u8) CborError!Decoded(Patch) {
+    try validate(a_bytes);
+    try validate(b_bytes);
+    const arena = try allocator.create(std.heap.ArenaAllocator);
+    errdefer allocator.destroy(arena);
+    arena.* = std.heap.ArenaAllocator.init(allocator);
+    errdefer arena.deinit();
+
+    var a_decoder = Decoder.init(arena, a_bytes, .{});
+    const a = try a_decoder.decodeDataItem();
+    var b_decoder = Decoder.init(arena, b_bytes, .{});
+    const b = try b_decoder.decodeDataItem();
+
+    const gpa = arena.allocator();
+    var changes: std.ArrayListUnmanaged(Patch.Change) = .empty;
+    switch (a) {
+        .map => |a_pairs| {
+            if (b != .map) return error.TypeMismatch;
+            for (b.map) |pair| {
+                if (findMapValue(a_pairs, pair.key)) |old| {
+                    if (dataItemsEqual(old, pair.value)) continue;
+                    try changes.append(gpa, .{ .op = .change, .key = pair.key, .value = pair.value });
+                } else {
+                    try changes.append(gpa, .{ .op = .add, .key = pair.key, .value = pair.value });
+                }
+            }
+            for (a_pairs) |pair| {
+                if (findMapValue(b.map, pair.key) == null) try changes.append(gpa, .{ .op = .remove, .key = pair.key });
+            }
+        },
+        .array => |a_items| {
+            if (b != .array) return error.TypeMismatch;
+            const common = @min(a_items.len, b.array.len);
+            for (a_items[0..common], b.array[0..common], 0..) |old, new, i| {
+                if (!dataItemsEqual(old, new)) try changes.append(gpa, .{ .op = .change, .key = .{ .uint = i }, .value = new });
+            }
+            for (b.array[common..], common..) |new, i| {
+                try changes.append(gpa, .{ .op = .add, .key = .{ .uint = i }, .value = new });
+            }
+            var i = a_items.len;
+            while (i > common) {
+                i -= 1;
+                try changes.append(gpa, .{ .op = .remove, .key = .{ .uint = i } });
+            }
+        },
+        else => return error.TypeMismatch,
+    }
+    return .{ .arena = arena, .value = .{ .changes = try changes.toOwnedSlice(gpa) } };
+}
+
+/// Applies `patch` to the encoded document `base` and returns the encoding
+/// of the result, which the caller owns. Map entries that are added go after
+/// the existing ones.
+pub fn apply(allocator: Allocator, base: []const u8, patch: Patch) CborError![]u8 {
+    try validate(base);
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+    var decoder = Decoder.init(&arena, base, .{});
+    const gpa = arena.allocator();
+
+    const result: DataItem = switch (try decoder.decodeDataItem()) {
+        .map => |pairs| blk: {
+            var list: std.ArrayListUnmanaged(DataItem.Pair) = .empty;
+            try list.appendSlice(gpa, pairs);
+            for (patch.changes) |change| {
+                const index: ?usize = for (list.items, 0..) |pair, i| {
+                    if (dataItemsEqual(pair.key, change.key)) break i;
+                } else null;
+                switch (change.op) {
+                    .add => {
+                        if (index != null) return error.DuplicateKey;
+                        try list.append(gpa, .{ .key = change.key, .value = change.value });
+                    },
+                    .change => list.items[index orelse return error.PatchMismatch].value = change.value,
+                    .remove => _ = list.orderedRemove(index orelse return error.PatchMismatch),
+                }
+            }
+            break :blk .{ .map = list.items };
+        },
+        .array => |items| blk: {
+            var list: std.ArrayListUnmanaged(DataItem) = .empty;
+            try list.appendSlice(gpa, items);
+            for (patch.changes) |change| {
+                if (change.key != .uint) return error.PatchMismatch;
+                const index = std.math.cast(usize, change.key.uint) orelse return error.PatchMismatch;
+                const limit = if (change.op == .add) list.items.len + 1 else list.items.len;
+                if (index >= limit) return error.PatchMismatch;
+                switch (change.op) {
+                    .add => try list.insert(gpa, index, change.value),
+                    .change => list.items[index] = change.value,
+                    .remove => _ = list.orderedRemove(index),
+                }
+            }
+            break :blk .{ .array = list.items };
+        },
+        else => return error.TypeMismatch,
+    };
+
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+    var encoder = Encoder{ .writer = out.writer() };
+    try encoder.encodeDataItem(result);
+    return out.toOwnedSlice();
+}
+
+/// Orders two encoded items by their core deterministic encodings (bytewise,
+/// as RFC 8949 section 4.2.1 sorts map keys). Forms of one value that differ
+/// only in head width, indefinite lengths, map key order or float width
+/// compare equal.
+pub fn compareCanonical(allocator: Allocator, a_bytes: []const u8, b_bytes: []const u8) CborError!std.math.Order {
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+    const a = try canonicalEncoding(&arena, a_bytes);
+    const b = try canonicalEncoding(&arena, b_bytes);
+    return std.mem.order(u8, a, b);
+}
+
+fn canonicalEncoding(arena: *std.heap.ArenaAllocator, bytes: []const u8) CborError![]const u8 {
+    try validate(bytes);
+    var decoder = Decoder.init(arena, bytes, .{});
+    const item = try decoder.decodeDataItem();
+    var out = std.ArrayList(u8).init(arena.allocator());
+    var encoder = Encoder{ .writer = out.writer(), .options = .{ .deterministic = true } };
+    try encoder.encodeDataItem(item);
+    return out.items;
+}
+
+fn findMapValue(pairs: []const DataItem.Pair, key: DataItem) ?DataItem {
+    for (pairs) |pair| {
+        if (dataItemsEqual(pair.key, key)) return pair.value;
+    }
+    return null;
+}
+
+// Structural equality. Floats compare by value regardless of wire width, and
+// NaN equals NaN so that an unchanged NaN isn't reported as a change.
+fn dataItemsEqual(a: DataItem, b: DataItem) bool {
+    if (std.meta.activeTag(a) != std.meta.activeTag(b)) return false;
+    return switch (a) {
+        .uint => |v| v == b.uint,
+        .nint => |v| v == b.nint,
+        .bytes => |v| std.mem.eql(u8, v, b.bytes),
+        .text => |v| std.mem.eql(u8, v, b.text),
+        .array => |items| items.len == b.array.len and for (items, b.array) |x, y| {
+            if (!dataItemsEqual(x, y)) break false;
+        } else true,
+        .map => |pairs| pairs.len == b.map.len and for (pairs, b.map) |x, y| {
+            if (!dataItemsEqual(x.key, y.key) or !dataItemsEqual(x.value, y.value)) break false;
+        } else true,
+        .tag => |tag| tag.number == b.tag.number and dataItemsEqual(tag.content.*, b.tag.content.*),
+        .float => |float| float.value == b.float.value or
+            (std.math.isNan(float.value) and std.math.isNan(b.float.value)),
+        .bool => |v| v == b.bool,
+        .null, .undefined => true,
+        .simple => |v| v == b.simple,
+    };
+}
+
+/// Expected shape of a document, for `validateAgainst`. `Schema.of(T)`
+/// derives one from a type: struct fields without a default and not optional
+/// are required, and integers are limited to their type's range or to the
+/// `[min, max]` given in `pub const cbor_ranges = .{ .field = .{ 0, 150 } }`.
+/// Recursive types are not supported.
+pub const Schema = struct {
+    kind: Kind,
+    nullable: bool = false,
+    /// Inclusive bounds for `.int`.
+    min: ?i128 = null,
+    max: ?i128 = null,
+    /// Element schema for `.array`.
+    element: ?*const Schema = null,
+    /// Expected entries for `.map`.
+    fields: []const Field = &.{},
+
+    pub const Kind = enum {
+        any,
+        bool,
+        int,
+        float,
+        /// A byte or text string.
+        string,
+        array,
+        map,
+    };
+
+    pub const Field = struct {
+        name: []const u8,
+        /// Integer map key also accepted for the field (see `cbor_keys`).
+        int_key: ?i64 = null,
+        required: bool,
+        schema: Schema,
+    };
+
+    pub fn of(comptime T: type) Schema {
+        comptime {
+            return switch (@typeInfo(T)) {
+                .bool => .{ .kind = .bool },
+                .int => .{
+                    .kind = .int,
+                    .min = @max(std.math.minInt(T), std.math.minInt(i128)),
+                    .max = @min(std.math.maxInt(T), std.math.maxInt(i128)),
+                },
+                .float => .{ .kind = .float },
+                .optional => |opt| blk: {
+                    var child = of(opt.child);
+                    child.nullable = true;
+                    break :blk child;
+                },
+                .array => |arr| if (arr.child == u8)
+                    .{ .kind = .string }
+                else
+                    .{ .kind = .array, .element = schemaPtr(arr.child) },
+                .pointer => |ptr| switch (ptr.size) {
+                    .slice => if (ptr.child == u8) .{ .kind = .string } else .{ .kind = .array, .element = schemaPtr(ptr.child) },
+                    .one => of(ptr.child),
+                    else => .{ .kind = .any },
+                },
+                .@"struct" => if (T == DataItem or T == RawCbor or isHashMap(T) or isUnmanagedHashMap(T) or
+                    T == std.SemanticVersion or T == std.Uri or T == ExtendedTime or isBoundedArray(T) or isArrayListUnmanaged(T) or
+                    isEnumSet(T) or isEnumMap(T) or isBitSet(T) or isPackedIntArray(T) or isStaticStringMap(T) or
+                    @typeInfo(T).@"struct".is_tuple)
+                    .{ .kind = .any }
+                else
+                    .{ .kind = .map, .fields = schemaFields(T) },
+                else => .{ .kind = .any },
+            };
+        }
+    }
+
+    fn schemaPtr(comptime T: type) *const Schema {
+        return &struct {
+            const value = of(T);
+        }.value;
+    }
+
+    fn schemaFields(comptime T: type) []const Field {
+        return &struct {
+            const value = blk: {
+                var fields: [keyedFieldCount(T)]Field = undefined;
+                var n: usize = 0;
+                for (std.meta.fields(T)) |field| {
+                    if (!isKeyedField(T, field.name)) continue;
+                    var schema = of(field.type);
+                    if (@hasDecl(T, "cbor_ranges") and @hasField(@TypeOf(T.cbor_ranges), field.name)) {
+                        const range = @field(T.cbor_ranges, field.name);
+                        schema.min = range[0];
+                        schema.max = range[1];
+                    }
+                    fields[n] = .{
+                        .name = field.name,
+                        .int_key = fieldIntKey(T, field.name),
+                        .required = field.default_value_ptr == null and @typeInfo(field.type) != .optional,
+                        .schema = schema,
+                    };
+                    n += 1;
+                }
+                break :blk fields;
+            };
+        }.value;
+    }
+};
+
+pub const Violation = struct {
+    /// Dotted path to the offending value, e.g. "address.city" or "items.2";
+    /// empty for the top-level item.
+    path: []const u8,
+    kind: Kind,
+
+    pub const Kind = enum { missing_field, type_mismatch, out_of_range };
+};
+
+/// Checks `bytes` against `schema` and lists every violation found, without
+/// decoding into a typed value. Extra map keys are allowed. An empty list
+/// means the document conforms; malformed input is an error instead.
+pub fn validateAgainst(allocator: Allocator, schema: Schema, bytes: []const u8) CborError!Decoded([]const Violation) {
+    try validate(bytes);
+    const arena = try allocator.create(std.heap.ArenaAllocator);
+    errdefer allocator.destroy(arena);
+    arena.* = std.heap.ArenaAllocator.init(allocator);
+    errdefer arena.deinit();
+
+    var decoder = Decoder.init(arena, bytes, .{});
+    const item = try decoder.decodeDataItem();
+    var checker = SchemaChecker{ .allocator = arena.allocator() };
+    try checker.check(schema, item, "");
+    return .{ .arena = arena, .value = checker.violations.items };
+}
+
+const SchemaChecker = struct {
+    allocator: Allocator,
+    violations: std.ArrayListUnmanaged(Violation) = .empty,
+
+    fn check(self: *SchemaChecker, schema: Schema, item: DataItem, path: []const u8) CborError!void {
+        if (item == .null and schema.nullable) return;
+        switch (schema.kind) {
+            .any => {},
+            .bool => if (item != .bool) try self.report(path, .type_mismatch),
+            .float => if (item != .float) try self.report(path, .type_mismatch),
+            .string => if (item != .bytes and item != .text) try self.report(path, .type_mismatch),
+            .int => {
+                const value: i128 = switch (item) {
+                    .uint => |v| v,
+                    .nint => |v| -1 - @as(i128, v),
+                    else => return self.report(path, .type_mismatch),
+                };
+                const below = if (schema.min) |min| value < min else false;
+                const above = if (schema.max) |max| value > max else false;
+                if (below or above) try self.report(path, .out_of_range);
+            },
+            .array => {
+                if (item != .array) return self.report(path, .type_mismatch);
+                for (item.array, 0..) |child, i| {
+                    const child_path = if (path.len == 0)
+                        try std.fmt.allocPrint(self.allocator, "{d}", .{i})
+                    else
+                        try std.fmt.allocPrint(self.allocator, "{s}.{d}", .{ path, i });
+                    try self.check(schema.element.?.*, child, child_path);
+                }
+            },
+            .map => {
+                if (item != .map) return self.report(path, .type_mismatch);
+                for (schema.fields) |field| {
+                    const child_path = if (path.len == 0)
+                        field.name
+                    else
+                        try std.fmt.allocPrint(self.allocator, "{s}.{s}", .{ path, field.name });
+                    const value = for (item.map) |pair| {
+                        if (fieldKeyMatches(field, pair.key)) break pair.value;
+                    } else {
+                        if (field.required) try self.report(child_path, .missing_field);
+                        continue;
+                    };
+                    try self.check(field.schema, value, child_path);
+                }
+            },
+        }
+    }
+
+    fn fieldKeyMatches(field: Schema.Field, key: DataItem) bool {
+        return switch (key) {
+            .text => |name| std.mem.eql(u8, name, field.name),
+            .uint => |v| if (field.int_key) |int_key| int_key >= 0 and v == int_key else false,
+            .nint => |v| if (field.int_key) |int_key| int_key < 0 and v == -(int_key + 1) else false,
+            else => false,
+        };
+    }
+
+    fn report(self: *SchemaChecker, path: []const u8, kind: Violation.Kind) CborError!void {
+        try self.violations.append(self.allocator, .{ .path = path, .kind = kind });
+    }
+};
+
+/// Decodes a tag 1 epoch timestamp into nanoseconds. Integer seconds are
+/// exact; float seconds are rounded once, from the exact value of the float,
+/// to the nearest nanosecond with ties to even.
+pub fn decodeEpochNanos(bytes: []const u8) CborError!i128 {
+    var stream = std.io.fixedBufferStream(bytes);
+    const reader = stream.reader();
+    const tag = try decodeHead(reader);
+    if (tag.major != 6 or tag.arg != 1) return error.TypeMismatch;
+    if (stream.pos == bytes.len) return error.EndOfStream;
+    const add_info = bytes[stream.pos] & 0x1F;
+    const head = try decodeHead(reader);
+    if (head.indefinite) return error.TypeMismatch;
+    return switch (head.major) {
+        0 => @as(i128, head.arg) * std.time.ns_per_s,
+        1 => (-1 - @as(i128, head.arg)) * std.time.ns_per_s,
+        7 => switch (add_info) {
+            25 => floatSecondsToNanos(@as(f16, @bitCast(@as(u16, @intCast(head.arg))))),
+            26 => floatSecondsToNanos(@as(f32, @bitCast(@as(u32, @intCast(head.arg))))),
+            27 => floatSecondsToNanos(@bitCast(head.arg)),
+            else => error.TypeMismatch,
+        },
+        else => error.TypeMismatch,
+    };
+}
+
+fn floatSecondsToNanos(seconds: f64) CborError!i128 {
+    if (!std.math.isFinite(seconds) or @abs(seconds) >= 1e29) return error.IntegerOutOfRange;
+    const whole = @trunc(seconds);
+    var nanos = @as(i128, @intFromFloat(whole)) * std.time.ns_per_s;
+
+    // The fraction is exactly mantissa / 2^shift; scale it by 10^9 in integer
+    // arithmetic so that rounding happens only once.
+    const frac = @abs(seconds - whole);
+    if (frac == 0) return nanos;
+    const parts = std.math.frexp(frac);
+    const mantissa: u128 = @intFromFloat(std.math.ldexp(parts.significand, 53));
+    const shift: u32 = @intCast(53 - parts.exponent);
+    const product = mantissa * std.time.ns_per_s;
+    var rounded: u128 = 0;
+    if (shift < 128) {
+        const s: u7 = @intCast(shift);
+        rounded = product >> s;
+        const rem = product - (rounded << s);
+        const half = @as(u128, 1) << @intCast(shift - 1);
+        if (rem > half or (rem == half and rounded & 1 == 1)) rounded += 1;
+    }
+    if (seconds < 0) nanos -= @intCast(rounded) else nanos += @intCast(rounded);
+    return nanos;
+}
+
+/// Wire form of a tagged union, selected with `pub const cbor_union_format`
+/// on the union type or, for unions without one, `union_format` in the
+/// encode and decode options.
+pub const UnionFormat = enum {
+    /// `[variant_name, payload]`
+    name_array,
+    /// `[discriminant, payload]` using the tag enum's integer value.
+    int_array,
+    /// `{variant_name: payload}`
+    single_key_map,
+    /// The payload alone. Decoding tries each variant in declaration order
+    /// and keeps the first that decodes, failing with
+    /// `error.NoMatchingVariant` if none does.
+    untagged,
+};
+
+pub const DataItemType = enum {
+    uint,
+    nint,
+    bytes,
+    text,
+    array,
+    map,
+    tag,
+    float,
+    simple,
+};
+
+/// Classifies the top-level item from its initial byte without decoding it.
+pub fn peekType(bytes: []const u8) CborError!DataItemType {
+    if (bytes.len == 0) return error.EndOfStream;
+    const head = bytes[0];
+    return switch (head >> 5) {
+        0 => .uint,
+        1 => .nint,
+        2 => .bytes,
+        3 => .text,
+        4 => .array,
+        5 => .map,
+        6 => .tag,
+        7 => switch (head & 0x1F) {
+            25, 26, 27 => .float,
+            28...31 => error.InvalidAdditionalInfo,
+            else => .simple,
+        },
+        else => unreachable,
+    };
+}
+
+/// Returns the tag number of the top-level item, or null if it is not a tag.
+pub fn peekTag(bytes: []const u8) CborError!?u64 {
+    if (try peekType(bytes) != .tag) return null;
+    var stream = std.io.fixedBufferStream(bytes[1..]);
+    return try readArgument(stream.reader(), bytes[0] & 0x1F);
+}
+
+pub const TaggedItem = struct {
+    tag: u64,
+    /// Encoding of the tagged content item, a sub-slice of the input.
+    content: []const u8,
+};
+
+/// Splits the top-level item into its outer tag number and the encoded
+/// content, for dispatching on tags by hand. Fails with `error.TypeMismatch`
+/// if the item is not a tag.
+pub fn decodeTag(bytes: []const u8) CborError!TaggedItem {
+    try validate(bytes);
+    if (try peekType(bytes) != .tag) return error.TypeMismatch;
+    var stream = std.io.fixedBufferStream(bytes);
+    const head = try decodeHead(stream.reader());
+    return .{ .tag = head.arg, .content = bytes[stream.pos..] };
+}
+
+/// Checks that `bytes` holds exactly one well-formed data item.
+pub fn validate(bytes: []const u8) CborError!void {
+    var stream = std.io.fixedBufferStream(bytes);
+    var walker = Walker{ .stream = &stream };
+    try walker.skip((DecodeOptions{}).max_nesting_depth);
+    if (stream.pos != bytes.len) return error.TrailingBytes;
+}
+
+/// Allocation-free boolean form of `validate`.
+pub fn isWellFormed(bytes: []const u8) bool {
+    validate(bytes) catch return false;
+    return true;
+}
+
+pub const EncodedItem = struct {
+    /// Encoding of the item, owned by the caller.
+    bytes: []u8,
+    /// Input bytes the item took up.
+    consumed: usize,
+};
+
+/// Checks the first item of a CBOR sequence and returns a copy of its
+/// encoding. Nothing is decoded; the bytes are only walked.
+pub fn copyEncoded(allocator: Allocator, bytes: []const u8) CborError!EncodedItem {
+    var stream = std.io.fixedBufferStream(bytes);
+    var walker = Walker{ .stream = &stream };
+    try walker.skip((DecodeOptions{}).max_nesting_depth);
+    return .{ .bytes = try allocator.dupe(u8, bytes[0..stream.pos]), .consumed = stream.pos };
+}
+
+pub const ValidationError = struct {
+    offset: usize,
+    kind: CborError,
+};
+
+/// Checks every item of a CBOR sequence and reports each malformed spot
+/// instead of stopping at the first. After an error the scan resumes at the
+/// byte following the offending one, so later reports are best-effort.
+/// The caller owns the returned slice.
+pub fn validateCollect(bytes: []const u8, allocator: Allocator) CborError![]ValidationError {
+    var errors: std.ArrayListUnmanaged(ValidationError) = .empty;
+    errdefer errors.deinit(allocator);
+    var stream = std.io.fixedBufferStream(bytes);
+    while (stream.pos < bytes.len) {
+        const start = stream.pos;
+        var walker = Walker{ .stream = &stream };
+        walker.skip((DecodeOptions{}).max_nesting_depth) catch |err| {
+            const offset = if (stream.pos > start) stream.pos - 1 else start;
+            try errors.append(allocator, .{ .offset = offset, .kind = err });
+            if (err == error.EndOfStream) break;
+            stream.pos = offset + 1;
+        };
+    }
+    return errors.toOwnedSlice(allocator);
+}
+
+/// Extra restrictions layered on top of `validateCanonical`.
+pub const CanonicalProfile = struct {
+    /// When false, simple values other than false, true, null and undefined
+    /// are rejected with `error.SimpleValueForbidden`.
+    allow_simple_values: bool = true,
+};
+
+/// Like `validate`, additionally requiring core deterministic encoding:
+/// shortest-form arguments and floats, definite lengths only, and map keys in
+/// strictly ascending bytewise order.
+pub fn validateCanonical(bytes: []const u8) CborError!void {
+    return validateCanonicalProfile(bytes, .{});
+}
+
+/// Allocation-free boolean form of `validateCanonical`, e.g. to check a
+/// buffer before hashing it.
+pub fn isCanonical(bytes: []const u8) bool {
+    validateCanonical(bytes) catch return false;
+    return true;
+}
+
+/// `validateCanonical` with the restrictions of `profile` applied.
+pub fn validateCanonicalProfile(bytes: []const u8, profile: CanonicalProfile) CborError!void {
+    var stream = std.io.fixedBufferStream(bytes);
+    var walker = Walker{ .stream = &stream, .canonical = true, .allow_simple_values = profile.allow_simple_values };
+    try walker.skip((DecodeOptions{}).max_nesting_depth);
+    if (stream.pos != bytes.len) return error.TrailingBytes;
+}
+
+/// Renders a single encoded item in diagnostic notation (RFC 8949 section 8).
+pub fn toDiagnostic(allocator: Allocator, bytes: []const u8) CborError![]u8 {
+    return renderDiagnostic(allocator, bytes, false);
+}
+
+/// Like `toDiagnostic`, but puts every item on its own line after a comment
+/// with its byte offset and head, e.g. `# 0x00: array(2)`.
+pub fn toAnnotatedDiagnostic(allocator: Allocator, bytes: []const u8) CborError![]u8 {
+    return renderDiagnostic(allocator, bytes, true);
+}
+
+fn renderDiagnostic(allocator: Allocator, bytes: []const u8, annotate: bool) CborError![]u8 {
+    try validate(bytes);
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+    var stream = std.io.fixedBufferStream(bytes);
+    var writer = DiagnosticWriter{ .stream = &stream, .out = out.writer(), .annotate = annotate };
+    try writer.item(0);
+    if (annotate) try out.append('\n');
+    return out.toOwnedSlice();
+}
+
+// Input has already been validated, so lengths and nesting are trusted.
+const DiagnosticWriter = struct {
+    stream: *std.io.FixedBufferStream([]const u8),
+    out: std.ArrayList(u8).Writer,
+    annotate: bool,
+
+    fn item(self: *DiagnosticWriter, depth: u32) CborError!void {
+        const start = self.stream.pos;
+        const reader = self.stream.reader();
+        const head = try reader.readByte();
+        const major_type = head >> 5;
+        const add_info = head & 0x1F;
+        const indefinite = add_info == 31;
+        const arg = if (indefinite) 0 else try readArgument(reader, add_info);
+
+        if (self.annotate) {
+            try self.indent(depth);
+            try self.out.print("# 0x{x:0>2}: ", .{start});
+            try self.describe(major_type, add_info, arg);
+            try self.out.writeByte('\n');
+            try self.indent(depth);
+        }
+
+        switch (major_type) {
+            0 => try self.out.print("{d}", .{arg}),
+            1 => try self.out.print("{d}", .{-1 - @as(i128, arg)}),
+            2, 3 => {
+                if (indefinite) {
+                    try self.out.writeAll("(_ ");
+                    try self.children(depth, null, false);
+                    return self.out.writeByte(')');
+                }
+                const data = self.stream.buffer[self.stream.pos..][0..@intCast(arg)];
+                self.stream.pos += data.len;
+                if (major_type == 2) {
+                    try self.out.print("h'{}'", .{std.fmt.fmtSliceHexLower(data)});
+                } else {
+                    try self.writeText(data);
+                }
+            },
+            4 => {
+                try self.out.writeAll(if (indefinite) "[_ " else "[");
+                try self.children(depth, if (indefinite) null else arg, false);
+                try self.out.writeByte(']');
+            },
+            5 => {
+                try self.out.writeAll(if (indefinite) "{_ " else "{");
+                try self.children(depth, if (indefinite) null else arg, true);
+                try self.out.writeByte('}');
+            },
+            6 => {
+                try self.out.print("{d}(", .{arg});
+                try self.children(depth, 1, false);
+                try self.out.writeByte(')');
+            },
+            else => switch (add_info) {
+                20 => try self.out.writeAll("false"),
+                21 => try self.out.writeAll("true"),
+                22 => try self.out.writeAll("null"),
+                23 => try self.out.writeAll("undefined"),
+                25 => try self.writeFloat(@as(f16, @bitCast(@as(u16, @intCast(arg))))),
+                26 => try self.writeFloat(@as(f32, @bitCast(@as(u32, @intCast(arg))))),
+                27 => try self.writeFloat(@bitCast(arg)),
+                else => try self.out.print("simple({d})", .{arg}),
+            },
+        }
+    }
+
+    // Writes `len` child items (or pairs), or until a break when `len` is null.
+    fn children(self: *DiagnosticWriter, depth: u32, len: ?u64, pairs: bool) CborError!void {
+        var i: u64 = 0;
+        while (if (len) |n| i < n else !try self.consumeBreak()) : (i += 1) {
+            if (i > 0) try self.out.writeAll(if (self.annotate) "," else ", ");
+            if (self.annotate) try self.out.writeByte('\n');
+            try self.item(depth + 1);
+            if (pairs) {
+                try self.out.writeAll(if (self.annotate) ":\n" else ": ");
+                try self.item(depth + 1);
+            }
+        }
+        if (self.annotate and i > 0) {
+            try self.out.writeByte('\n');
+            try self.indent(depth);
+        }
+    }
+
+    fn consumeBreak(self: *DiagnosticWriter) CborError!bool {
+        if (self.stream.buffer[self.stream.pos] != 0xff) return false;
+        self.stream.pos += 1;
+        return true;
+    }
+
+    fn describe(self: *DiagnosticWriter, major_type: u8, add_info: u8, arg: u64) CborError!void {
+        const name = switch (major_type) {
+            0 => "unsigned",
+            1 => "negative",
+            2 => "bytes",
+            3 => "text",
+            4 => "array",
+            5 => "map",
+            6 => "tag",
+            else => switch (add_info) {
+                25 => return self.out.writeAll("float16"),
+                26 => return self.out.writeAll("float32"),
+                27 => return self.out.writeAll("float64"),
+                else => "simple",
+            },
+        };
+        if (add_info == 31) return self.out.print("{s}(*)", .{name});
+        try self.out.print("{s}({d})", .{ name, arg });
+    }
+
+    fn indent(self: *DiagnosticWriter, depth: u32) CborError!void {
+        try self.out.writeByteNTimes(' ', depth * 2);
+    }
+
+    fn writeText(self: *DiagnosticWriter, text: []const u8) CborError!void {
+        try self.out.writeByte('"');
+        for (text) |c| switch (c) {
+            '"' => try self.out.writeAll("\\\""),
+            '\\' => try self.out.writeAll("\\\\"),
+            '\n' => try self.out.writeAll("\\n"),
+            0...0x09, 0x0b...0x1f => try self.out.print("\\u{x:0>4}", .{c}),
+            else => try self.out.writeByte(c),
+        };
+        try self.out.writeByte('"');
+    }
+
+    fn writeFloat(self: *DiagnosticWriter, value: f64) CborError!void {
+        if (std.math.isNan(value)) return self.out.writeAll("NaN");
+        if (std.math.isInf(value)) return self.out.writeAll(if (value > 0) "Infinity" else "-Infinity");
+        var buf: [64]u8 = undefined;
+        const text = std.fmt.bufPrint(&buf, "{d}", .{value}) catch unreachable;
+        try self.out.writeAll(text);
+        if (std.mem.indexOfAny(u8, text, ".e") == null) try self.out.writeAll(".0");
+    }
+};
+
+/// Converts one encoded item to JSON. Byte strings become unpadded base64url
+/// strings, tags are dropped, and non-finite floats and simple values other
+/// than booleans become null. Map keys must be text or integers.
+pub fn toJson(allocator: Allocator, bytes: []const u8) CborError![]u8 {
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+    try writeJson(out.writer(), bytes);
+    return out.toOwnedSlice();
+}
+
+/// Streaming form of `toJson`: output goes straight to `writer`.
+pub fn writeJson(writer: anytype, bytes: []const u8) (CborError || @TypeOf(writer).Error)!void {
+    try validate(bytes);
+    var stream = std.io.fixedBufferStream(bytes);
+    var json = JsonWriter(@TypeOf(writer)){ .stream = &stream, .out = writer };
+    try json.item();
+}
+
+// Input has already been validated, so lengths and nesting are trusted.
+fn JsonWriter(comptime Writer: type) type {
+    return struct {
+        stream: *std.io.FixedBufferStream([]const u8),
+        out: Writer,
+
+        const Self = @This();
+        const Error = CborError || Writer.Error;
+
+        fn item(self: *Self) Error!void {
+            const reader = self.stream.reader();
+            const head = try reader.readByte();
+            const major_type = head >> 5;
+            const add_info = head & 0x1F;
+            const indefinite = add_info == 31;
+            const arg = if (indefinite) 0 else try readArgument(reader, add_info);
+
+            switch (major_type) {
+                0 => try self.out.print("{d}", .{arg}),
+                1 => try self.out.print("{d}", .{-1 - @as(i128, arg)}),
+                2 => {
+                    var base64 = Base64Url{};
+                    try self.out.writeByte('"');
+                    if (indefinite) {
+                        while (!self.consumeBreak()) {
+                            const chunk_head = try reader.readByte();
+                            try base64.feed(self.out, self.take(try readArgument(reader, chunk_head & 0x1F)));
+                        }
+                    } else {
+                        try base64.feed(self.out, self.take(arg));
+                    }
+                    try base64.finish(self.out);
+                    try self.out.writeByte('"');
+                },
+                3 => {
+                    try self.out.writeByte('"');
+                    if (indefinite) {
+                        while (!self.consumeBreak()) {
+                            const chunk_head = try reader.readByte();
+                            try self.writeEscaped(self.take(try readArgument(reader, chunk_head & 0x1F)));
+                        }
+                    } else {
+                        try self.writeEscaped(self.take(arg));
+                    }
+                    try self.out.writeByte('"');
+                },
+                4 => {
+                    try self.out.writeByte('[');
+                    var i: u64 = 0;
+                    while (if (indefinite) !self.consumeBreak() else i < arg) : (i += 1) {
+                        if (i > 0) try self.out.writeByte(',');
+                        try self.item();
+                    }
+                    try self.out.writeByte(']');
+                },
+                5 => {
+                    try self.out.writeByte('{');
+                    var i: u64 = 0;
+                    while (if (indefinite) !self.consumeBreak() else i < arg) : (i += 1) {
+                        if (i > 0) try self.out.writeByte(',');
+                        try self.key();
+                        try self.out.writeByte(':');
+                        try self.item();
+                    }
+                    try self.out.writeByte('}');
+                },
+                6 => try self.item(),
+                else => switch (add_info) {
+                    20 => try self.out.writeAll("false"),
+                    21 => try self.out.writeAll("true"),
+                    25 => try self.writeFloat(@as(f16, @bitCast(@as(u16, @intCast(arg))))),
+                    26 => try self.writeFloat(@as(f32, @bitCast(@as(u32, @intCast(arg))))),
+                    27 => try self.writeFloat(@bitCast(arg)),
+                    else => try self.out.writeAll("null"),
+                },
+            }
+        }
+
+        // JSON object keys are strings, so integer keys are quoted.
+        fn key(self: *Self) Error!void {
+            const major_type = self.stream.buffer[self.stream.pos] >> 5;
+            switch (major_type) {
+                3 => try self.item(),
+                0, 1 => {
+                    try self.out.writeByte('"');
+                    try self.item();
+                    try self.out.writeByte('"');
+                },
+                else => return error.TypeMismatch,
+            }
+        }
+
+        fn take(self: *Self, len: u64) []const u8 {
+            const data = self.stream.buffer[self.stream.pos..][0..@intCast(len)];
+            self.stream.pos += data.len;
+            return data;
+        }
+
+        fn consumeBreak(self: *Self) bool {
+            if (self.stream.buffer[self.stream.pos] != 0xff) return false;
+            self.stream.pos += 1;
+            return true;
+        }
+
+        fn writeEscaped(self: *Self, text: []const u8) Error!void {
+            for (text) |c| switch (c) {
+                '"' => try self.out.writeAll("\\\""),
+                '\\' => try self.out.writeAll("\\\\"),
+                '\n' => try self.out.writeAll("\\n"),
+                '\r' => try self.out.writeAll("\\r"),
+                '\t' => try self.out.writeAll("\\t"),
+                0...0x08, 0x0b, 0x0c, 0x0e...0x1f => try self.out.print("\\u{x:0>4}", .{c}),
+                else => try self.out.writeByte(c),
+            };
+        }
+
+        fn writeFloat(self: *Self, value: f64) Error!void {
+            if (std.math.isNan(value) or std.math.isInf(value)) return self.out.writeAll("null");
+            try self.out.print("{d}", .{value});
+        }
+    };
+}
+
+// Unpadded base64url over input that arrives in pieces.
+const Base64Url = struct {
+    pending: [3]u8 = undefined,
+    pending_len: usize = 0,
+
+    const encoder = std.base64.url_safe_no_pad.Encoder;
+
+    fn feed(self: *Base64Url, writer: anytype, data: []const u8) !void {
+        var rest = data;
+        while (rest.len > 0) {
+            const n = @min(3 - self.pending_len, rest.len);
+            @memcpy(self.pending[self.pending_len..][0..n], rest[0..n]);
+            self.pending_len += n;
+            rest = rest[n..];
+            if (self.pending_len == 3) try self.flush(writer);
+        }
+    }
+
+    fn finish(self: *Base64Url, writer: anytype) !void {
+        if (self.pending_len > 0) try self.flush(writer);
+    }
+
+    fn flush(self: *Base64Url, writer: anytype) !void {
+        var buf: [4]u8 = undefined;
+        try writer.writeAll(encoder.encode(&buf, self.pending[0..self.pending_len]));
+        self.pending_len = 0;
+    }
+};
+
+// Walks over encoded items without allocating, checking well-formedness.
+const Walker = struct {
+    stream: *std.io.FixedBufferStream([]const u8),
+    canonical: bool = false,
+    allow_simple_values: bool = true,
+    on_non_minimal: ?NonMinimalCallback = null,
+
+    // `depth` is the number of nesting levels still allowed.
+    fn skip(self: *Walker, depth: u32) CborError!void {
+        if (depth == 0) return error.NestingDepthExceeded;
+        const reader = self.stream.reader();
+        const head = try reader.readByte();
+        const major_type = head >> 5;
+        const add_info = head & 0x1F;
+
+        if (add_info == 31) {
+            if (self.canonical and major_type >= 2 and major_type <= 5) return error.IndefiniteInCanonical;
+            switch (major_type) {
+                2, 3 => while (!try self.consumeBreak()) {
+                    const chunk = try reader.readByte();
+                    if (chunk >> 5 != major_type or chunk & 0x1F == 31) return error.InvalidStringChunk;
+                    const len = try readArgument(reader, chunk & 0x1F);
+                    if (self.on_non_minimal) |callback| {
+                        if (!isMinimalArgument(chunk & 0x1F, len)) {
+                            callback.func(callback.context, self.stream.pos - argumentLen(chunk & 0x1F) - 1);
+                        }
+                    }
+                    try reader.skipBytes(len, .{});
+                },
+                4 => while (!try self.consumeBreak()) try self.skip(depth - 1),
+                5 => while (!try self.consumeBreak()) {
+                    try self.skip(depth - 1);
+                    try self.skip(depth - 1);
+                },
+                7 => return error.UnexpectedBreak,
+                else => return error.InvalidAdditionalInfo,
+            }
+            return;
+        }
+
+        // For major type 7 the argument is the simple value or float payload.
+        const arg = try readArgument(reader, add_info);
+        // Simple values below 32 have no two-byte form; RFC 8949 makes that
+        // malformed, not merely non-canonical.
+        if (major_type == 7 and add_info == 24 and arg < 32) return error.InvalidAdditionalInfo;
+        if (self.canonical) try checkCanonicalArgument(major_type, add_info, arg);
+        if (!self.allow_simple_values and major_type == 7 and add_info <= 24 and (arg < 20 or arg > 23)) {
+            return error.SimpleValueForbidden;
+        }
+        if (self.on_non_minimal) |callback| {
+            if (major_type != 7 and !isMinimalArgument(add_info, arg)) {
+                callback.func(callback.context, self.stream.pos - argumentLen(add_info) - 1);
+            }
+        }
+        switch (major_type) {
+            0, 1, 7 => {},
+            2, 3 => try reader.skipBytes(arg, .{}),
+            4 => {
+                var i: u64 = 0;
+                while (i < arg) : (i += 1) try self.skip(depth - 1);
+            },
+            5 => {
+                var previous_key: []const u8 = &.{};
+                var i: u64 = 0;
+                while (i < arg) : (i += 1) {
+                    const key_start = self.stream.pos;
+                    try self.skip(depth - 1);
+                    const key = self.stream.buffer[key_start..self.stream.pos];
+                    if (self.canonical and i > 0) {
+                        switch (std.mem.order(u8, previous_key, key)) {
+                            .lt => {},
+                            .eq => return error.DuplicateKey,
+                            .gt => return error.UnsortedMapKeys,
+                        }
+                    }
+                    previous_key = key;
+                    try self.skip(depth - 1);
+                }
+            },
+            6 => try self.skip(depth - 1),
+            else => unreachable,
+        }
+    }
+
+    fn consumeBreak(self: *Walker) CborError!bool {
+        if (self.stream.pos >= self.stream.buffer.len) return error.EndOfStream;
+        if (self.stream.buffer[self.stream.pos] != 0xff) return false;
+        self.stream.pos += 1;
+        return true;
+    }
+
+    fn checkCanonicalArgument(major_type: u8, add_info: u8, arg: u64) CborError!void {
+        if (major_type == 7) {
+            switch (add_info) {
+                26 => {
+                    const value: f32 = @bitCast(@as(u32, @intCast(arg)));
+                    if (@as(f16, @floatCast(value)) == value) return error.NonCanonicalFloat;
+                },
+                27 => {
+                    const value: f64 = @bitCast(arg);
+                    if (@as(f32, @floatCast(value)) == value) return error.NonCanonicalFloat;
+                },
+                else => {},
+            }
+            return;
+        }
+        if (!isMinimalArgument(add_info, arg)) return error.NonCanonicalInteger;
+    }
+};
+
+// Lengths on the wire are 64-bit. Where `Size` (usize on the target) is
+// narrower, a length that doesn't fit is rejected instead of truncated.
+fn lengthAs(comptime Size: type, len: u64) CborError!Size {
+    return std.math.cast(Size, len) orelse error.LengthExceedsPlatform;
+}
+
+fn isMinimalArgument(add_info: u8, arg: u64) bool {
+    return switch (add_info) {
+        24 => arg >= 24,
+        25 => arg > std.math.maxInt(u8),
+        26 => arg > std.math.maxInt(u16),
+        27 => arg > std.math.maxInt(u32),
+        else => true,
+    };
+}
+
+fn argumentLen(add_info: u8) usize {
+    return switch (add_info) {
+        24 => 1,
+        25 => 2,
+        26 => 4,
+        27 => 8,
+        else => 0,
+    };
+}
+
+// Strict UTF-8: overlong forms and encoded surrogates are rejected too.
+fn checkUtf8(text: []const u8) CborError!void {
+    if (!std.unicode.utf8ValidateSlice(text)) return error.InvalidUtf8;
+}
+
+/// Writes an item head with `value` as its argument in the shortest form.
+pub fn encodeHead(writer: anytype, major: u3, value: u64) @TypeOf(writer).Error!void {
+    const mt = @as(u8, major) << 5;
+    if (value < 24) {
+        try writer.writeByte(mt | @as(u5, @intCast(value)));
+    } else if (value <= std.math.maxInt(u8)) {
+        try writer.writeByte(mt | 24);
+        try writer.writeInt(u8, @as(u8, @intCast(value)), .big);
+    } else if (value <= std.math.maxInt(u16)) {
+        try writer.writeByte(mt | 25);
+        try writer.writeInt(u16, @as(u16, @intCast(value)), .big);
+    } else if (value <= std.math.maxInt(u32)) {
+        try writer.writeByte(mt | 26);
+        try writer.writeInt(u32, @as(u32, @intCast(value)), .big);
+    } else {
+        try writer.writeByte(mt | 27);
+        try writer.writeInt(u64, value, .big);
+    }
+}
+
+/// Upper bound on the encoded size of any value of `T` under any encode
+/// options, for sizing static buffers. `T` must have a fixed layout; slices,
+/// hash maps and other dynamically sized types are a compile error.
+pub fn maxEncodedLen(comptime T: type) comptime_int {
+    return comptime maxLen(T);
+}
+
+// Only called at comptime.
+fn maxLen(comptime T: type) usize {
+    if (T == SimpleValue) return 2;
+    if (T == DataItem or T == RawCbor or hasStreamEncoder(T)) {
+        @compileError("maxEncodedLen: " ++ @typeName(T) ++ " has no fixed encoded size");
+    }
+    return switch (@typeInfo(T)) {
+        .bool, .void => 1,
+        // Wider integers may need a tag 2/3 bignum.
+        .int => |int_info| if (int_info.bits > 64)
+            1 + headLen((int_info.bits + 7) / 8) + (int_info.bits + 7) / 8
+        else
+            headLen(std.math.maxInt(T)),
+        .float => |float_info| switch (float_info.bits) {
+            32 => 5,
+            64 => 9,
+            else => @compileError("Unsupported float size."),
+        },
+        .@"enum" => blk: {
+            var max: usize = 0;
+            for (std.meta.fieldNames(T)) |name| max = @max(max, textLen(name));
+            break :blk max;
+        },
+        .error_set => |errors| blk: {
+            var max: usize = 0;
+            for (errors orelse @compileError("maxEncodedLen: anyerror has no fixed encoded size")) |err| {
+                max = @max(max, textLen(err.name));
+            }
+            break :blk max;
+        },
+        .error_union => |eu| containerLen(1) + @max(textLen("ok") + maxLen(eu.payload), textLen("err") + maxLen(eu.error_set)),
+        .optional => |opt| @max(1, maxLen(opt.child)),
+        .array => |arr| if (arr.child == u8)
+            headLen(arr.len) + arr.len
+        else
+            containerLen(arr.len) + arr.len * maxLen(arr.child),
+        .vector => |vec| containerLen(vec.len) + vec.len * maxLen(vec.child),
+        // String literals and pointers to byte arrays match `[N]u8`.
+        .pointer => |ptr| if (ptr.size == .one)
+            maxLen(ptr.child)
+        else
+            @compileError("maxEncodedLen: " ++ @typeName(T) ++ " has no fixed encoded size"),
+        .@"union" => |union_info| blk: {
+            if (isNetAddress(T)) break :blk containerLen(2) + headLen(16) + 16 + maxLen(u16);
+            if (union_info.tag_type == null) @compileError("Only tagged unions are supported.");
+            // Tagged formats spend a container head on the array or map, then
+            // the variant name or discriminant, then the payload; untagged is
+            // never longer.
+            var max: usize = 0;
+            for (union_info.fields) |field| {
+                const discriminant: i128 = @intFromEnum(@field(union_info.tag_type.?, field.name));
+                const arg: u64 = @intCast(if (discriminant < 0) -(discriminant + 1) else discriminant);
+                max = @max(max, containerLen(2) + @max(textLen(field.name), headLen(arg)) + maxLen(field.type));
+            }
+            break :blk max;
+        },
+        .@"struct" => blk: {
+            if (T == std.SemanticVersion or T == std.Uri or isHashMap(T) or isUnmanagedHashMap(T) or
+                isArrayListUnmanaged(T) or isStaticStringMap(T) or extraFieldName(T) != null)
+            {
+                @compileError("maxEncodedLen: " ++ @typeName(T) ++ " has no fixed encoded size");
+            }
+            if (isEnumSet(T)) {
+                var total = containerLen(std.meta.fields(T.Key).len);
+                for (std.meta.fieldNames(T.Key)) |name| total += textLen(name);
+                break :blk total;
+            }
+            if (isEnumMap(T)) {
+                var total = containerLen(std.meta.fields(T.Key).len);
+                for (std.meta.fieldNames(T.Key)) |name| total += textLen(name) + maxLen(T.Value);
+                break :blk total;
+            }
+            // Tag, map head, key 1 with an i64, key -9 with a u32.
+            if (T == ExtendedTime) break :blk 3 + containerLen(2) + (1 + 9) + (1 + 5);
+            if (@typeInfo(T).@"struct".is_tuple) {
+                var total = containerLen(std.meta.fields(T).len);
+                for (std.meta.fields(T)) |field| total += maxLen(field.type);
+                break :blk total;
+            }
+            if (isPackedIntArray(T)) break :blk containerLen(T.len) + T.len * maxLen(T.Child);
+            if (isBitSet(T)) {
+                const as_bytes = headLen(bitSetByteLen(T)) + bitSetByteLen(T);
+                break :blk if (T.bit_length <= 64) @max(as_bytes, headLen(std.math.maxInt(std.meta.Int(.unsigned, T.bit_length)))) else as_bytes;
+            }
+            var total = containerLen(keyedFieldCount(T));
+            for (std.meta.fields(T)) |field| {
+                if (!isKeyedField(T, field.name)) continue;
+                total += encodedFieldKey(T, field.name).len + maxLen(field.type);
+            }
+            break :blk total;
+        },
+        else => @compileError("maxEncodedLen: unsupported type " ++ @typeName(T)),
+    };
+}
+
+fn headLen(arg: u64) usize {
+    if (arg < 24) return 1;
+    if (arg <= std.math.maxInt(u8)) return 2;
+    if (arg <= std.math.maxInt(u16)) return 3;
+    if (arg <= std.math.maxInt(u32)) return 5;
+    return 9;
+}
+
+fn textLen(text: []const u8) usize {
+    return headLen(text.len) + text.len;
+}
+
+// The larger of a definite header and an indefinite header plus break.
+fn containerLen(len: usize) usize {
+    return @max(headLen(len), 2);
+}
+
+pub const Head = struct {
+    major: u3,
+    /// The argument; for major type 7 this is the simple value or the raw
+    /// float bits.
+    arg: u64,
+    /// Set for indefinite-length strings and containers, and for the break
+    /// code (major type 7).
+    indefinite: bool,
+};
+
+pub fn decodeHead(reader: anytype) CborError!Head {
+    const head = try reader.readByte();
+    const major: u3 = @intCast(head >> 5);
+    const add_info = head & 0x1F;
+    if (add_info == 31) {
+        return switch (major) {
+            2, 3, 4, 5, 7 => .{ .major = major, .arg = 0, .indefinite = true },
+            else => error.InvalidAdditionalInfo,
+        };
+    }
+    return .{ .major = major, .arg = try readArgument(reader, add_info), .indefinite = false };
+}
+
+fn readArgument(reader: anytype, add_info: u8) CborError!u64 {
+    return switch (add_info) {
+        0...23 => @intCast(add_info),
+        24 => try reader.readInt(u8, .big),
+        25 => try reader.readInt(u16, .big),
+        26 => try reader.readInt(u32, .big),
+        27 => try reader.readInt(u64, .big),
+        else => error.InvalidAdditionalInfo,
+    };
+}
+
+// A struct may collect map entries that match none of its fields by naming a
+// string-keyed hash map field in `pub const cbor_extra`. Those entries are
+// written back out after the named fields on encode.
+fn extraFieldName(comptime T: type) ?[]const u8 {
+    return if (@hasDecl(T, "cbor_extra")) T.cbor_extra else null;
+}
+
+// Fields named in `pub const cbor_skip` are never encoded, and matching keys
+// are ignored on decode; the field keeps its default value (or zero).
+fn isSkippedField(comptime T: type, comptime name: []const u8) bool {
+    if (!@hasDecl(T, "cbor_skip")) return false;
+    inline for (T.cbor_skip) |skipped| {
+        if (std.mem.eql(u8, skipped, name)) return true;
+    }
+    return false;
+}
+
+// Runtime form of `isSkippedField` for incoming map keys, which keeps them
+// out of `cbor_extra`.
+fn isSkippedKey(comptime T: type, key: []const u8) bool {
+    if (!@hasDecl(T, "cbor_skip")) return false;
+    inline for (T.cbor_skip) |skipped| {
+        if (std.mem.eql(u8, skipped, key)) return true;
+    }
+    return false;
+}
+
+// Whether a struct field holding `field_value` is left out of the map: null
+// optionals under `omit_null_fields`, and the outer null of `??T` always.
+fn isOmittedField(options: EncodeOptions, field_value: anytype) bool {
+    return switch (@typeInfo(@TypeOf(field_value))) {
+        .optional => |opt| field_value == null and (options.omit_null_fields or @typeInfo(opt.child) == .optional),
+        else => false,
+    };
+}
+
+// Whether a struct field is written as a key of its own.
+fn isKeyedField(comptime T: type, comptime name: []const u8) bool {
+    if (extraFieldName(T)) |extra| {
+        if (std.mem.eql(u8, extra, name)) return false;
+    }
+    return !isSkippedField(T, name);
+}
+
+// `pub const cbor_keys = .{ .field = 1 }` gives fields integer map keys in
+// place of their names, as used by CTAP2 and COSE. Decoding accepts either
+// the integer key or the field name.
+fn fieldIntKey(comptime T: type, comptime name: []const u8) ?i64 {
+    if (!@hasDecl(T, "cbor_keys") or !@hasField(@TypeOf(T.cbor_keys), name)) return null;
+    return @field(T.cbor_keys, name);
+}
+
+// The encoded map key of a field: its integer key or its name as text.
+// Only called at comptime.
+fn encodedFieldKey(comptime T: type, comptime name: []const u8) []const u8 {
+    var buf: [9 + name.len]u8 = undefined;
+    var stream = std.io.fixedBufferStream(&buf);
+    const writer = stream.writer();
+    if (fieldIntKey(T, name)) |int_key| {
+        if (int_key < 0) {
+            encodeHead(writer, 1, @intCast(-(int_key + 1))) catch unreachable;
+        } else {
+            encodeHead(writer, 0, @intCast(int_key)) catch unreachable;
+        }
+    } else {
+        encodeHead(writer, 3, name.len) catch unreachable;
+        writer.writeAll(name) catch unreachable;
+    }
+    const key = buf[0..stream.pos].*;
+    return &key;
+}
+
+// Keyed field names in map key order. Only called at comptime.
+fn sortedFieldNames(comptime T: type, comptime order: EncodeOptions.KeyOrder) [keyedFieldCount(T)][]const u8 {
+    var names: [keyedFieldCount(T)][]const u8 = undefined;
+    var n: usize = 0;
+    for (std.meta.fields(T)) |field| {
+        if (!isKeyedField(T, field.name)) continue;
+        names[n] = field.name;
+        n += 1;
+    }
+    @setEvalBranchQuota(10_000 + names.len * names.len * 100);
+    // Insertion sort; the comparison mirrors Encoder.sortEntries.
+    for (1..names.len) |i| {
+        var j = i;
+        while (j > 0 and keyBefore(encodedFieldKey(T, names[j]), encodedFieldKey(T, names[j - 1]), order)) : (j -= 1) {
+            const tmp = names[j];
+            names[j] = names[j - 1];
+            names[j - 1] = tmp;
+        }
+    }
+    return names;
+}
+
+// Keyed field names sorted by name. Only called at comptime.
+fn alphabeticalFieldNames(comptime T: type) [keyedFieldCount(T)][]const u8 {
+    var names: [keyedFieldCount(T)][]const u8 = undefined;
+    var n: usize = 0;
+    for (std.meta.fields(T)) |field| {
+        if (!isKeyedField(T, field.name)) continue;
+        names[n] = field.name;
+        n += 1;
+    }
+    @setEvalBranchQuota(10_000 + names.len * names.len * 100);
+    std.mem.sort([]const u8, &names, {}, struct {
+        fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+            return std.mem.lessThan(u8, a, b);
+        }
+    }.lessThan);
+    return names;
+}
+
+fn keyBefore(a: []const u8, b: []const u8, order: EncodeOptions.KeyOrder) bool {
+    if (order == .length_first and a.len != b.len) return a.len < b.len;
+    return std.mem.lessThan(u8, a, b);
+}
+
+fn keyedFieldCount(comptime T: type) usize {
+    var count: usize = 0;
+    for (std.meta.fields(T)) |field| {
+        if (isKeyedField(T, field.name)) count += 1;
+    }
+    return count;
+}
+
+// Maps the names of keyed fields to their field tag at comptime, so that
+// struct decoding doesn't compare each incoming key against every field.
+fn fieldNameMap(comptime T: type) std.StaticStringMap(std.meta.FieldEnum(T)) {
+    const Entry = struct { []const u8, std.meta.FieldEnum(T) };
+    var entries: [keyedFieldCount(T)]Entry = undefined;
+    var n: usize = 0;
+    for (std.meta.fields(T)) |field| {
+        if (!isKeyedField(T, field.name)) continue;
+        entries[n] = .{ field.name, @field(std.meta.FieldEnum(T), field.name) };
+        n += 1;
+    }
+    return .initComptime(entries);
+}
+
+fn enumNameMap(comptime T: type) std.StaticStringMap(T) {
+    const Entry = struct { []const u8, T };
+    const fields = std.meta.fields(T);
+    var entries: [fields.len]Entry = undefined;
+    for (fields, &entries) |field, *entry| entry.* = .{ field.name, @enumFromInt(field.value) };
+    return .initComptime(entries);
+}
+
+fn fieldDefault(comptime field: std.builtin.Type.StructField) ?field.type {
+    const ptr = field.default_value_ptr orelse return null;
+    return @as(*const field.type, @ptrCast(@alignCast(ptr))).*;
+}
+
+// The value `empty_as_null` decodes an empty buffer to.
+fn emptyValue(comptime T: type) T {
+    switch (@typeInfo(T)) {
+        .optional => return null,
+        .@"struct" => |info| {
+            var result: T = undefined;
+            inline for (info.fields) |field| {
+                if (field.is_comptime) continue;
+                @field(result, field.name) = comptime fieldDefault(field) orelse emptyValue(field.type);
+            }
+            return result;
+        },
+        .pointer => |ptr| if (ptr.size == .one or ptr.size == .many) {
+            @compileError("empty_as_null: " ++ @typeName(T) ++ " has no empty value; give the field a default or make it optional");
+        },
+        else => {},
+    }
+    return std.mem.zeroes(T);
+}
+
+// How strings map to CBOR: string literals (`*const [N:0]u8`) are text
+// strings, while `[]const u8`, `[]u8` and `[N]u8` are byte strings. Use
+// `Encoder.encodeString` to write a slice as text.
+fn isStringLiteral(comptime T: type) bool {
+    const ptr = switch (@typeInfo(T)) {
+        .pointer => |ptr| ptr,
+        else => return false,
+    };
+    if (ptr.size != .one) return false;
+    return switch (@typeInfo(ptr.child)) {
+        .array => |arr| arr.child == u8 and arr.sentinel_ptr != null,
+        else => false,
+    };
+}
+
+// `pub fn encodeCborStream(self: T, encoder: *Encoder) CborError!void` lets a
+// type write its own encoding piece by piece, e.g. as chunks of an
+// indefinite-length string.
+fn hasStreamEncoder(comptime T: type) bool {
+    return switch (@typeInfo(T)) {
+        .@"struct", .@"union", .@"enum" => @hasDecl(T, "encodeCborStream"),
+        else => false,
+    };
+}
+
+fn isSlice(comptime T: type) bool {
+    return switch (@typeInfo(T)) {
+        .pointer => |ptr| ptr.size == .slice,
+        else => false,
+    };
+}
+
+fn isByteSlice(comptime T: type) bool {
+    return switch (@typeInfo(T)) {
+        .pointer => |ptr| ptr.size == .slice and ptr.child == u8,
+        else => false,
+    };
+}
+
+// `std.BoundedArray` travels like a slice of its element type. Byte arrays
+// take a byte or text string straight into the buffer, without allocating;
+// more elements than the capacity fail with `error.CapacityExceeded`.
+fn isBoundedArray(comptime T: type) bool {
+    return @hasField(T, "buffer") and @hasField(T, "len") and
+        @hasDecl(T, "constSlice") and @hasDecl(T, "fromSlice");
+}
+
+// Managed `std.HashMap` and `std.ArrayHashMap` types map to CBOR maps. Entries
+// are written in iteration order, which is insertion order for array hash
+// maps, unless the encoder is deterministic.
+fn isHashMap(comptime T: type) bool {
+    return @hasDecl(T, "KV") and @hasDecl(T, "iterator") and @hasDecl(T, "getOrPut") and
+        @hasField(T, "unmanaged") and @hasField(T, "allocator");
+}
+
+// Unmanaged hash maps are written like managed ones. Decoded maps and
+// `std.ArrayListUnmanaged` items live in the decode arena, so grow them with
+// an allocator that can resize that memory (or not at all).
+fn isUnmanagedHashMap(comptime T: type) bool {
+    return @hasDecl(T, "KV") and @hasDecl(T, "iterator") and @hasDecl(T, "getOrPut") and
+        @hasDecl(T, "empty") and !@hasField(T, "allocator");
+}
+
+fn isArrayListUnmanaged(comptime T: type) bool {
+    if (!@hasField(T, "items") or !@hasField(T, "capacity") or @hasField(T, "allocator")) return false;
+    const items = @typeInfo(@FieldType(T, "items"));
+    return items == .pointer and T == std.ArrayListUnmanaged(items.pointer.child);
+}
+
+// `std.EnumSet` travels as an array of member names; decoding also accepts
+// the members' integer values.
+fn isEnumSet(comptime T: type) bool {
+    return @hasDecl(T, "Key") and @typeInfo(T.Key) == .@"enum" and T == std.EnumSet(T.Key);
+}
+
+// `std.StaticStringMap` is encoded as a map with text keys. It can't be
+// decoded into, since it is built at comptime.
+fn isStaticStringMap(comptime T: type) bool {
+    return @hasDecl(T, "initComptime") and @hasDecl(T, "getLongestPrefix") and
+        @hasDecl(T, "keys") and @hasDecl(T, "values");
+}
+
+// `std.enums.EnumMap` is encoded as a map from enum keys to values.
+fn isEnumMap(comptime T: type) bool {
+    return @hasDecl(T, "Key") and @hasDecl(T, "Value") and @typeInfo(T.Key) == .@"enum" and
+        T == std.enums.EnumMap(T.Key, T.Value);
+}
+
+// `std.net.Address` is encoded as `[address_bytes, port]` with a 4-byte IPv4
+// or 16-byte IPv6 address. IPv6 flow info and scope id are not carried.
+fn isNetAddress(comptime T: type) bool {
+    if (builtin.os.tag == .freestanding) return false;
+    return T == std.net.Address;
+}
+
+fn unionFormat(comptime T: type, default: UnionFormat) UnionFormat {
+    return if (@hasDecl(T, "cbor_union_format")) T.cbor_union_format else default;
+}
+
+// `std.PackedIntArray` travels as an array of its unpacked integers.
+fn isPackedIntArray(comptime T: type) bool {
+    if (!@hasDecl(T, "Child") or !@hasDecl(T, "len") or !@hasField(T, "bytes")) return false;
+    return T == std.PackedIntArrayEndian(T.Child, .little, T.len) or
+        T == std.PackedIntArrayEndian(T.Child, .big, T.len);
+}
+
+// `std.bit_set.IntegerBitSet` and `ArrayBitSet` are encoded as a byte string
+// holding bit `i` at byte `i / 8`, position `i % 8`.
+fn isBitSet(comptime T: type) bool {
+    return @hasDecl(T, "bit_length") and @hasDecl(T, "MaskInt") and
+        (@hasField(T, "mask") or @hasField(T, "masks"));
+}
+
+fn bitSetByteLen(comptime T: type) usize {
+    return (T.bit_length + 7) / 8;
+}
+
+// Wraps the decode allocator and fails once the running total of requested
+// bytes would exceed `remaining`. Frees are not credited back, so the budget
+// bounds everything handed out during a single decode.
+const BudgetAllocator = struct {
+    child: Allocator,
+    remaining: usize,
+    exceeded: bool = false,
+
+    fn allocator(self: *BudgetAllocator) Allocator {
+        return .{
+            .ptr = self,
+            .vtable = &.{
+                .alloc = alloc,
+                .resize = resize,
+                .remap = remap,
+                .free = free,
+            },
+        };
+    }
+
+    fn charge(self: *BudgetAllocator, len: usize) bool {
+        if (len > self.remaining) {
+            self.exceeded = true;
+            return false;
+        }
+        self.remaining -= len;
+        return true;
+    }
+
+    fn alloc(ctx: *anyopaque, len: usize, alignment: std.mem.Alignment, ret_addr: usize) ?[*]u8 {
+        const self: *BudgetAllocator = @ptrCast(@alignCast(ctx));
+        if (len > self.remaining) {
+            self.exceeded = true;
+            return null;
+        }
+        const ptr = self.child.rawAlloc(len, alignment, ret_addr) orelse return null;
+        self.remaining -= len;
+        return ptr;
+    }
+
+    fn resize(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, new_len: usize, ret_addr: usize) bool {
+        const self: *BudgetAllocator = @ptrCast(@alignCast(ctx));
+        const growth = if (new_len > memory.len) new_len - memory.len else 0;
+        if (growth > self.remaining) {
+            self.exceeded = true;
+            return false;
+        }
+        if (!self.child.rawResize(memory, alignment, new_len, ret_addr)) return false;
+        return self.charge(growth);
+    }
+
+    fn remap(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, new_len: usize, ret_addr: usize) ?[*]u8 {
+        const self: *BudgetAllocator = @ptrCast(@alignCast(ctx));
+        const growth = if (new_len > memory.len) new_len - memory.len else 0;
+        if (growth > self.remaining) {
+            self.exceeded = true;
+            return null;
+        }
+        const ptr = self.child.rawRemap(memory, alignment, new_len, ret_addr) orelse return null;
+        _ = self.charge(growth);
+        return ptr;
+    }
+
+    fn free(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, ret_addr: usize) void {
+        const self: *BudgetAllocator = @ptrCast(@alignCast(ctx));
+        self.child.rawFree(memory, alignment, ret_addr);
+    }
+};
+
+test "deserialize request with missing optional field" {
+    const allocator = std.testing.allocator;
+    const Operation = enum { create };
+    const OpsTarget = enum { document, index };
+    const Ops = union(OpsTarget) { document: Operation, index: Operation };
+    const MyRequest = struct {
+        operation: Ops,
+        space: ?[]const u8 = null,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const cbor_bytes = &.{ 0xa1, 0x69, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x82, 0x68, 0x64, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x66, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65 };
+
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+    const req = try serde.deserialize(cbor_bytes, MyRequest);
+
+    try std.testing.expect(req.operation.document == .create);
+    try std.testing.expect(req.space == null);
+}
+
+test "deserialize fails on missing required field" {
+    const allocator = std.testing.allocator;
+    const MyRequest = struct {
+        id: u64,
+        name: []const u8,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const cbor_bytes = &.{ 0xa1, 0x62, 0x69, 0x64, 0x18, 0x7b };
+
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const result = serde.deserialize(cbor_bytes, MyRequest);
+    try std.testing.expectError(error.MissingRequiredField, result);
+}
+
+test "serialize and deserialize struct with optional field" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        id: u64,
+        name: []const u8,
+        description: ?[]const u8 = null,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = MyStruct{
+        .id = 42,
+        .name = "Test",
+        .description = null,
+    };
+
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const deserialized = try serde.deserialize(serialized, MyStruct);
+
+    try std.testing.expect(deserialized.id == original.id);
+    try std.testing.expect(std.mem.eql(u8, deserialized.name, original.name));
+    try std.testing.expect(deserialized.description == null);
+}
+
+test "extract field from serialized data" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        id: u64,
+        name: []const u8,
+        city: []const u8,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = MyStruct{
+        .id = 42,
+        .name = "Test",
+        .city = "Pune",
+    };
+
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    const extracted_id = try serde.extractField(serialized, "id", u64);
+    try std.testing.expect(extracted_id == 42);
+
+    const extracted_name = try serde.extractField(serialized, "name", []const u8);
+    if (extracted_name) |name| {
+        std.debug.print("Extracted name: {s}\n", .{name});
+        try std.testing.expect(std.mem.eql(u8, name, "Test"));
+    } else {
+        std.debug.print("Extracted name not found\n", .{});
+        try std.testing.expect(false);
+    }
+
+    const extracted_city = try serde.extractField(serialized, "city", []const u8);
+    if (extracted_city) |city| {
+        std.debug.print("Extracted city: {s}\n", .{city});
+        try std.testing.expect(std.mem.eql(u8, city, "Pune"));
+    } else {
+        std.debug.print("Extracted name not found\n", .{});
+        try std.testing.expect(false);
+    }
+}
+
+test "serde person struct with array of address structs" {
+    const allocator = std.testing.allocator;
+    const Address = struct {
+        street: []const u8,
+        city: []const u8,
+    };
+    const Person = struct {
+        name: []const u8,
+        age: u32,
+        addresses: []Address,
+    };
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const person = Person{
+        .name = "Alice",
+        .age = 30,
+        .addresses = try allocator.dupe(Address, &[_]Address{
+            Address{ .street = "123 Main St", .city = "Wonderland" },
+            Address{ .street = "456 Elm St", .city = "Dreamland" },
+        }),
+    };
+
+    defer allocator.free(person.addresses);
+
+    const serialized = try serde.serialize(person);
+    defer allocator.free(serialized);
+
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const deserialized_person = try serde.deserialize(serialized, Person);
+
+    try std.testing.expect(std.mem.eql(u8, deserialized_person.name, person.name));
+    try std.testing.expect(deserialized_person.age == person.age);
+    try std.testing.expect(deserialized_person.addresses.len == person.addresses.len);
+
+    for (0..deserialized_person.addresses.len) |i| {
+        try std.testing.expect(std.mem.eql(u8, deserialized_person.addresses[i].street, person.addresses[i].street));
+        try std.testing.expect(std.mem.eql(u8, deserialized_person.addresses[i].city, person.addresses[i].city));
+    }
+}
+
+test "serde struct with all sorts of types" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        id: u64,
+        age: i64,
+        score: f32,
+        name: []const u8,
+        active: bool,
+        tags: [][]const u8,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var tags_array = [_][]const u8{ "tag1", "tag2", "tag3" };
+
+    const original = MyStruct{
+        .id = 42,
+        .age = 30,
+        .score = 85.5,
+        .name = "Test",
+        .active = true,
+        .tags = &tags_array,
+    };
+
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const deserialized = try serde.deserialize(serialized, MyStruct);
+
+    try std.testing.expect(deserialized.id == original.id);
+    try std.testing.expect(std.mem.eql(u8, deserialized.name, original.name));
+    try std.testing.expect(deserialized.active == original.active);
+    try std.testing.expect(deserialized.tags.len == original.tags.len);
+    try std.testing.expect(deserialized.age == original.age);
+    try std.testing.expect(deserialized.score == original.score);
+    for (0..deserialized.tags.len) |i| {
+        try std.testing.expect(std.mem.eql(u8, deserialized.tags[i], original.tags[i]));
+    }
+}
+
+test "serde deeply nested up 5 levels" {
+    const allocator = std.testing.allocator;
+    const InnerMost = struct {
+        level: u8 = 5,
+        name: []const u8 = "InnerMost",
+        value: u64,
+    };
+    const Inner = struct {
+        level: u8 = 4,
+        name: []const u8 = "Inner",
+        inner_most: InnerMost,
+    };
+    const Middle = struct {
+        level: u8 = 3,
+        name: []const u8 = "Middle",
+        inner: Inner,
+    };
+    const Outer = struct {
+        level: u8 = 2,
+        name: []const u8 = "Outer",
+        middle: Middle,
+    };
+    const DeeplyNested = struct {
+        level: u8 = 1,
+        name: []const u8 = "DeeplyNested",
+        outer: Outer,
+    };
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = DeeplyNested{
+        .outer = Outer{
+            .middle = Middle{
+                .inner = Inner{
+                    .inner_most = InnerMost{ .value = 12345 },
+                },
+            },
+        },
+    };
+
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const deserialized = try serde.deserialize(serialized, DeeplyNested);
+
+    try std.testing.expect(deserialized.outer.middle.inner.inner_most.value == original.outer.middle.inner.inner_most.value);
+}
+
+test "deprecated Config limits forward to the decode options" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .max_nesting_depth = 8, .max_allocation_size = 2 });
+    defer serde.deinit();
+
+    try std.testing.expect(serde.config.decode.max_nesting_depth == 8);
+    try std.testing.expectError(error.AllocationTooLarge, serde.deserialize(&.{ 0x63, 'a', 'b', 'c' }, []const u8));
+}
+
+test "deserialize trips total allocation budget on many small strings" {
+    const allocator = std.testing.allocator;
+
+    const items = try allocator.alloc([]const u8, 2000);
+    defer allocator.free(items);
+    @memset(items, "abcdefgh");
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(items);
+    defer allocator.free(serialized);
+
+    // The slice spine alone fits; the 2000 string payloads push it over.
+    var limited = Serde.init(allocator, .{ .decode = .{ .max_total_alloc = 40_000 } });
+    defer limited.deinit();
+    const result = limited.deserialize(serialized, [][]const u8);
+    try std.testing.expectError(error.AllocationBudgetExceeded, result);
+
+    var roomy = Serde.init(allocator, .{ .decode = .{ .max_total_alloc = 64_000 } });
+    defer roomy.deinit();
+    const decoded = try roomy.deserialize(serialized, [][]const u8);
+    try std.testing.expect(decoded.len == items.len);
+}
+
+test "max_total_alloc covers hash map storage" {
+    const allocator = std.testing.allocator;
+
+    var entries = std.AutoHashMap(u32, u32).init(allocator);
+    defer entries.deinit();
+    for (0..1000) |i| try entries.put(@intCast(i), @intCast(i));
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(entries);
+    defer allocator.free(serialized);
+
+    var limited = Serde.init(allocator, .{ .decode = .{ .max_total_alloc = 4096 } });
+    defer limited.deinit();
+    try std.testing.expectError(error.AllocationBudgetExceeded, limited.deserialize(serialized, std.AutoHashMap(u32, u32)));
+    try std.testing.expectError(error.AllocationBudgetExceeded, limited.deserialize(serialized, std.AutoHashMapUnmanaged(u32, u32)));
+
+    // Unmatched keys collected by `cbor_extra` are charged the same way.
+    const Record = struct {
+        extra: std.StringHashMap(u32),
+        pub const cbor_extra = "extra";
+    };
+    var names = std.StringHashMap(u32).init(allocator);
+    defer names.deinit();
+    var keys: [300][8]u8 = undefined;
+    for (&keys, 0..) |*key, i| {
+        _ = std.fmt.bufPrint(key, "key{d:0>5}", .{i}) catch unreachable;
+        try names.put(key, @intCast(i));
+    }
+    const unmatched = try serde.serialize(names);
+    defer allocator.free(unmatched);
+    try std.testing.expectError(error.AllocationBudgetExceeded, limited.deserialize(unmatched, Record));
+
+    // The decoded map keeps a usable allocator once the decoder is gone.
+    var roomy = Serde.init(allocator, .{ .decode = .{ .max_total_alloc = 1 << 20 } });
+    defer roomy.deinit();
+    var decoded = try roomy.deserialize(serialized, std.AutoHashMap(u32, u32));
+    try std.testing.expect(decoded.count() == 1000);
+    try decoded.put(1000, 1000);
+    try std.testing.expect(decoded.get(1000).? == 1000);
+}
+
+test "serde bit sets as byte strings" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const Flags = std.bit_set.IntegerBitSet(40);
+    var flags = Flags.initEmpty();
+    flags.set(0);
+    flags.set(9);
+    flags.set(39);
+
+    const serialized = try serde.serialize(flags);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0x45, 0x01, 0x02, 0x00, 0x00, 0x80 }, serialized);
+
+    const decoded = try serde.deserialize(serialized, Flags);
+    try std.testing.expect(decoded.eql(flags));
+
+    const WideFlags = std.bit_set.ArrayBitSet(u8, 40);
+    var wide = WideFlags.initEmpty();
+    wide.set(0);
+    wide.set(9);
+    wide.set(39);
+
+    const wide_serialized = try serde.serialize(wide);
+    defer allocator.free(wide_serialized);
+    try std.testing.expectEqualSlices(u8, serialized, wide_serialized);
+    try std.testing.expect((try serde.deserialize(wide_serialized, WideFlags)).eql(wide));
+
+    // A 4-byte string cannot carry a 40-bit set.
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x44, 0x01, 0x02, 0x00, 0x00 }, Flags));
+}
+
+test "deserialize unmatched keys into catch-all field" {
+    const allocator = std.testing.allocator;
+    const Record = struct {
+        name: []const u8,
+        extra: std.StringHashMap(DataItem),
+
+        pub const cbor_extra = "extra";
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const input = DataItem{ .map = &.{
+        .{ .key = .{ .text = "name" }, .value = .{ .text = "widget" } },
+        .{ .key = .{ .text = "color" }, .value = .{ .text = "red" } },
+        .{ .key = .{ .text = "size" }, .value = .{ .uint = 3 } },
+    } };
+    const serialized = try serde.serialize(input);
+    defer allocator.free(serialized);
+
+    const decoded = try serde.deserialize(serialized, Record);
+    try std.testing.expectEqualStrings("widget", decoded.name);
+    try std.testing.expect(decoded.extra.count() == 2);
+    try std.testing.expectEqualStrings("red", decoded.extra.get("color").?.text);
+    try std.testing.expect(decoded.extra.get("size").?.uint == 3);
+
+    const reserialized = try serde.serialize(decoded);
+    defer allocator.free(reserialized);
+    try std.testing.expect(reserialized[0] == 0xa3);
+}
+
+test "serialize rejects deterministic combined with indefinite length" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        id: u64,
+        tags: []const []const u8,
+    };
+    var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = true, .indefinite_length = true } });
+    defer serde.deinit();
+
+    const result = serde.serialize(MyStruct{ .id = 1, .tags = &.{"a"} });
+    try std.testing.expectError(error.ConflictingOptions, result);
+}
+
+test "serialize struct deterministically sorts keys and shortens floats" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        zeta: u8,
+        alpha: u8,
+        mid: f64,
+    };
+    var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer serde.deinit();
+
+    const original = MyStruct{ .zeta = 1, .alpha = 2, .mid = 100000.5 };
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa3,
+        0x63, 'm', 'i', 'd', 0xfa, 0x47, 0xc3, 0x50, 0x40,
+        0x64, 'z', 'e', 't', 'a', 0x01,
+        0x65, 'a', 'l', 'p', 'h', 'a', 0x02,
+    }, serialized);
+
+    const deserialized = try serde.deserialize(serialized, MyStruct);
+    try std.testing.expect(deserialized.mid == original.mid);
+}
+
+test "deserialize floats of any width" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // Half and single floats widen into f64 fields.
+    try std.testing.expect(try serde.deserialize(&.{ 0xf9, 0x3e, 0x00 }, f64) == 1.5);
+    try std.testing.expect(try serde.deserialize(&.{ 0xfa, 0x47, 0xc3, 0x50, 0x40 }, f64) == 100000.5);
+
+    // A double narrows into an f32 field only when nothing is lost.
+    try std.testing.expect(try serde.deserialize(&.{ 0xfb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0 }, f32) == 0.5);
+    try std.testing.expect(std.math.isNan(try serde.deserialize(&.{ 0xfb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0 }, f32)));
+    const tenth = &.{ 0xfb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a };
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(tenth, f32));
+    const huge = &.{ 0xfb, 0x7e, 0x37, 0xe4, 0x3c, 0x88, 0x00, 0x75, 0x9c };
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(huge, f32));
+}
+
+test "serde indefinite length arrays and maps" {
+    const allocator = std.testing.allocator;
+    const MyStruct = struct {
+        id: u8,
+        tags: []const []const u8,
+    };
+    var serde = Serde.init(allocator, .{ .encode = .{ .indefinite_length = true } });
+    defer serde.deinit();
+
+    const original = MyStruct{ .id = 7, .tags = &.{ "a", "b" } };
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    try std.testing.expectEqualSlices(u8, &.{
+        0xbf,
+        0x62, 'i', 'd', 0x07,
+        0x64, 't', 'a', 'g', 's', 0x9f, 0x41, 'a', 0x41, 'b', 0xff,
+        0xff,
+    }, serialized);
+
+    const deserialized = try serde.deserialize(serialized, MyStruct);
+    try std.testing.expect(deserialized.id == 7);
+    try std.testing.expect(deserialized.tags.len == 2);
+    try std.testing.expectEqualStrings("b", deserialized.tags[1]);
+}
+
+test "peek type of top-level item" {
+    const cases = [_]struct { bytes: []const u8, expected: DataItemType }{
+        .{ .bytes = &.{0x00}, .expected = .uint },
+        .{ .bytes = &.{ 0x1b, 0, 0, 0, 0, 0, 0, 0, 1 }, .expected = .uint },
+        .{ .bytes = &.{0x20}, .expected = .nint },
+        .{ .bytes = &.{ 0x41, 0xff }, .expected = .bytes },
+        .{ .bytes = &.{ 0x61, 'a' }, .expected = .text },
+        .{ .bytes = &.{0x80}, .expected = .array },
+        .{ .bytes = &.{0x9f}, .expected = .array },
+        .{ .bytes = &.{0xa0}, .expected = .map },
+        .{ .bytes = &.{ 0xc1, 0x00 }, .expected = .tag },
+        .{ .bytes = &.{ 0xf9, 0x3e, 0x00 }, .expected = .float },
+        .{ .bytes = &.{ 0xfa, 0, 0, 0, 0 }, .expected = .float },
+        .{ .bytes = &.{ 0xfb, 0, 0, 0, 0, 0, 0, 0, 0 }, .expected = .float },
+        .{ .bytes = &.{0xf5}, .expected = .simple },
+        .{ .bytes = &.{0xf6}, .expected = .simple },
+        .{ .bytes = &.{ 0xf8, 0x20 }, .expected = .simple },
+    };
+    for (cases) |case| {
+        try std.testing.expectEqual(case.expected, try peekType(case.bytes));
+    }
+
+    try std.testing.expectError(error.EndOfStream, peekType(&.{}));
+    try std.testing.expectError(error.InvalidAdditionalInfo, peekType(&.{0xff}));
+}
+
+test "peek tag number of top-level item" {
+    try std.testing.expectEqual(@as(?u64, 1), try peekTag(&.{ 0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0 }));
+    try std.testing.expectEqual(@as(?u64, 32), try peekTag(&.{ 0xd8, 0x20, 0x60 }));
+    try std.testing.expectEqual(@as(?u64, 1000), try peekTag(&.{ 0xd9, 0x03, 0xe8, 0xa0 }));
+    try std.testing.expectEqual(@as(?u64, null), try peekTag(&.{ 0x82, 0x01, 0x02 }));
+    try std.testing.expectError(error.EndOfStream, peekTag(&.{0xd8}));
+    try std.testing.expectError(error.EndOfStream, peekTag(&.{}));
+}
+
+test "serde semantic version as text string" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const version = try std.SemanticVersion.parse("1.2.3-rc.1+build.5");
+    const serialized = try serde.serialize(version);
+    defer allocator.free(serialized);
+    try std.testing.expect(serialized[0] == 0x72);
+    try std.testing.expectEqualStrings("1.2.3-rc.1+build.5", serialized[1..]);
+
+    const decoded = try serde.deserialize(serialized, std.SemanticVersion);
+    try std.testing.expect(decoded.order(version) == .eq);
+    try std.testing.expectEqualStrings("rc.1", decoded.pre.?);
+    try std.testing.expectEqualStrings("build.5", decoded.build.?);
+
+    const malformed = try serde.serialize(DataItem{ .text = "1.2" });
+    defer allocator.free(malformed);
+    try std.testing.expectError(error.InvalidSemanticVersion, serde.deserialize(malformed, std.SemanticVersion));
+}
+
+test "serde honors cbor_skip fields" {
+    const allocator = std.testing.allocator;
+    const Cached = struct {
+        id: u32,
+        cache: ?[]const u8 = null,
+        hits: u32 = 0,
+        mutex: std.Thread.Mutex = .{},
+
+        pub const cbor_skip = .{ "cache", "hits", "mutex" };
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = Cached{ .id = 5, .cache = "warm", .hits = 3 };
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x62, 'i', 'd', 0x05 }, serialized);
+
+    const input = try serde.serialize(DataItem{ .map = &.{
+        .{ .key = .{ .text = "id" }, .value = .{ .uint = 5 } },
+        .{ .key = .{ .text = "hits" }, .value = .{ .uint = 9 } },
+    } });
+    defer allocator.free(input);
+
+    const decoded = try serde.deserialize(input, Cached);
+    try std.testing.expect(decoded.id == 5);
+    try std.testing.expect(decoded.cache == null);
+    try std.testing.expect(decoded.hits == 0);
+}
+
+test "cbor_skip keys are not collected into cbor_extra" {
+    const allocator = std.testing.allocator;
+    const Tracked = struct {
+        id: u32,
+        hits: u32 = 0,
+        extra: std.StringHashMap(u32),
+
+        pub const cbor_skip = .{"hits"};
+        pub const cbor_extra = "extra";
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const input = try serde.serialize(DataItem{ .map = &.{
+        .{ .key = .{ .text = "id" }, .value = .{ .uint = 5 } },
+        .{ .key = .{ .text = "hits" }, .value = .{ .uint = 9 } },
+        .{ .key = .{ .text = "other" }, .value = .{ .uint = 7 } },
+    } });
+    defer allocator.free(input);
+
+    const decoded = try serde.deserialize(input, Tracked);
+    try std.testing.expect(decoded.id == 5);
+    try std.testing.expect(decoded.hits == 0);
+    try std.testing.expect(decoded.extra.count() == 1);
+    try std.testing.expect(decoded.extra.get("other").? == 7);
+    try std.testing.expect(decoded.extra.get("hits") == null);
+
+    var tracked = decoded;
+    tracked.hits = 3;
+    const serialized = try serde.serialize(tracked);
+    defer allocator.free(serialized);
+    const again = try serde.deserialize(serialized, Tracked);
+    try std.testing.expect(again.hits == 0);
+    try std.testing.expect(again.extra.count() == 1);
+}
+
+test "serialize integer-keyed struct in deterministic key order" {
+    const allocator = std.testing.allocator;
+    const Request = struct {
+        rp: []const u8,
+        user: u8,
+        client_data_hash: []const u8,
+
+        pub const cbor_keys = .{ .client_data_hash = 1, .rp = 2, .user = 3 };
+    };
+    const original = Request{ .rp = "x", .user = 9, .client_data_hash = &.{ 0x01, 0x02 } };
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const declared = try serde.serialize(original);
+    defer allocator.free(declared);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x02, 0x41, 'x', 0x03, 0x09, 0x01, 0x42, 0x01, 0x02 }, declared);
+
+    var deterministic = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer deterministic.deinit();
+    const sorted = try deterministic.serialize(original);
+    defer allocator.free(sorted);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x01, 0x42, 0x01, 0x02, 0x02, 0x41, 'x', 0x03, 0x09 }, sorted);
+
+    const decoded = try deterministic.deserialize(sorted, Request);
+    try std.testing.expectEqualStrings("x", decoded.rp);
+    try std.testing.expect(decoded.user == 9);
+    try std.testing.expectEqualSlices(u8, &.{ 0x01, 0x02 }, decoded.client_data_hash);
+}
+
+test "serde union as discriminant array" {
+    const allocator = std.testing.allocator;
+    const Kind = enum(u8) { ping = 1, data = 7 };
+    const Message = union(Kind) {
+        ping: u8,
+        data: u32,
+
+        pub const cbor_union_format = .int_array;
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const serialized = try serde.serialize(Message{ .data = 300 });
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0x82, 0x07, 0x19, 0x01, 0x2c }, serialized);
+
+    const decoded = try serde.deserialize(serialized, Message);
+    try std.testing.expect(decoded.data == 300);
+
+    const ping = try serde.deserialize(&.{ 0x82, 0x01, 0x05 }, Message);
+    try std.testing.expect(ping.ping == 5);
+
+    try std.testing.expectError(error.InvalidEnumTag, serde.deserialize(&.{ 0x82, 0x05, 0x00 }, Message));
+}
+
+test "deserialize integer-keyed struct from string or integer keys" {
+    const allocator = std.testing.allocator;
+    const Credential = struct {
+        kind: []const u8,
+        alg: i32,
+
+        pub const cbor_keys = .{ .kind = 1, .alg = 3 };
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const by_name = try serde.serialize(DataItem{ .map = &.{
+        .{ .key = .{ .text = "kind" }, .value = .{ .text = "public-key" } },
+        .{ .key = .{ .text = "alg" }, .value = .{ .nint = 6 } },
+    } });
+    defer allocator.free(by_name);
+
+    const by_int = try serde.serialize(DataItem{ .map = &.{
+        .{ .key = .{ .uint = 1 }, .value = .{ .text = "public-key" } },
+        .{ .key = .{ .uint = 3 }, .value = .{ .nint = 6 } },
+    } });
+    defer allocator.free(by_int);
+
+    for ([_][]const u8{ by_name, by_int }) |bytes| {
+        const decoded = try serde.deserialize(bytes, Credential);
+        try std.testing.expectEqualStrings("public-key", decoded.kind);
+        try std.testing.expect(decoded.alg == -7);
+    }
+}
+
+test "splice pre-encoded bytes with writeRaw" {
+    const allocator = std.testing.allocator;
+    const Inner = struct {
+        city: []const u8,
+    };
+    const Outer = struct {
+        id: u8,
+        inner: Inner,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const cached = try serde.serialize(Inner{ .city = "Pune" });
+    defer allocator.free(cached);
+
+    var list = std.ArrayList(u8).init(allocator);
+    defer list.deinit();
+    var encoder = Encoder{ .writer = list.writer() };
+    try encoder.encodeMapHeader(2);
+    try encoder.encodeString("id");
+    try encoder.writeRaw(&.{0x07});
+    try encoder.encodeString("inner");
+    try encoder.writeRaw(cached);
+
+    const decoded = try serde.deserialize(list.items, Outer);
+    try std.testing.expect(decoded.id == 7);
+    try std.testing.expectEqualStrings("Pune", decoded.inner.city);
+
+    if (builtin.mode == .Debug) {
+        try std.testing.expectError(error.EndOfStream, encoder.writeRaw(&.{ 0x82, 0x01 }));
+        try std.testing.expectError(error.TrailingBytes, encoder.writeRaw(&.{ 0x01, 0x02 }));
+    }
+}
+
+test "serde enum set as array of names" {
+    const allocator = std.testing.allocator;
+    const Permission = enum { read, write, exec, admin };
+    const Permissions = std.EnumSet(Permission);
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = Permissions.initMany(&.{ .read, .exec, .admin });
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{
+        0x83,
+        0x64, 'r', 'e', 'a', 'd',
+        0x64, 'e', 'x', 'e', 'c',
+        0x65, 'a', 'd', 'm', 'i', 'n',
+    }, serialized);
+
+    const decoded = try serde.deserialize(serialized, Permissions);
+    try std.testing.expect(decoded.eql(original));
+
+    // Integer members and duplicates are accepted by default.
+    const from_ints = try serde.deserialize(&.{ 0x83, 0x00, 0x00, 0x02 }, Permissions);
+    try std.testing.expect(from_ints.eql(Permissions.initMany(&.{ .read, .exec })));
+
+    var strict = Serde.init(allocator, .{ .decode = .{ .reject_duplicate_keys = true } });
+    defer strict.deinit();
+    try std.testing.expectError(error.DuplicateKey, strict.deserialize(&.{ 0x83, 0x00, 0x00, 0x02 }, Permissions));
+}
+
+test "encode error names as text strings" {
+    const allocator = std.testing.allocator;
+    var list = std.ArrayList(u8).init(allocator);
+    defer list.deinit();
+
+    var encoder = Encoder{ .writer = list.writer() };
+    try encoder.encodeErrorName(error.FileNotFound);
+    try std.testing.expectEqualSlices(u8, "\x6cFileNotFound", list.items);
+
+    list.clearRetainingCapacity();
+    encoder.options.lowercase_error_names = true;
+    try encoder.encodeErrorName(error.OutOfMemory);
+    try std.testing.expectEqualSlices(u8, "\x6boutofmemory", list.items);
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const Report = struct {
+        code: u16,
+        err: anyerror,
+    };
+    const serialized = try serde.serialize(Report{ .code = 2, .err = error.AccessDenied });
+    defer allocator.free(serialized);
+    const decoded = try serde.deserialize(serialized, struct { code: u16, err: []const u8 });
+    try std.testing.expectEqualStrings("AccessDenied", decoded.err);
+}
+
+test "canonical decode rejects indefinite-length items" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .decode = .{ .require_canonical = true } });
+    defer serde.deinit();
+
+    const indefinite_array = &.{ 0x9f, 0x01, 0x02, 0xff };
+    try std.testing.expectError(error.IndefiniteInCanonical, serde.deserialize(indefinite_array, []const u8));
+    try std.testing.expectError(error.IndefiniteInCanonical, serde.deserialize(indefinite_array, []u32));
+
+    const definite = try serde.deserialize(&.{ 0x82, 0x01, 0x02 }, []u32);
+    try std.testing.expectEqualSlices(u32, &.{ 1, 2 }, definite);
+
+    for ([_][]const u8{
+        &.{ 0x5f, 0x41, 0x00, 0xff },
+        &.{ 0x7f, 0x61, 'a', 0xff },
+        &.{ 0xbf, 0x61, 'a', 0x01, 0xff },
+        &.{ 0x81, 0x9f, 0xff },
+    }) |bytes| {
+        try std.testing.expectError(error.IndefiniteInCanonical, validateCanonical(bytes));
+        try validate(bytes);
+    }
+}
+
+test "serde std.net.Address as address bytes and port" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const ip4 = std.net.Address.initIp4(.{ 127, 0, 0, 1 }, 8080);
+    const ip4_bytes = try serde.serialize(ip4);
+    defer allocator.free(ip4_bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0x82, 0x44, 127, 0, 0, 1, 0x19, 0x1f, 0x90 }, ip4_bytes);
+    try std.testing.expect((try serde.deserialize(ip4_bytes, std.net.Address)).eql(ip4));
+
+    const ip6 = try std.net.Address.parseIp6("2001:db8::1", 443);
+    const ip6_bytes = try serde.serialize(ip6);
+    defer allocator.free(ip6_bytes);
+    try std.testing.expect(ip6_bytes.len == 1 + 1 + 16 + 3);
+    const decoded = try serde.deserialize(ip6_bytes, std.net.Address);
+    try std.testing.expect(decoded.eql(ip6));
+    try std.testing.expect(decoded.getPort() == 443);
+}
+
+test "data item floats keep their wire width" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const cases = [_][]const u8{
+        &.{ 0xf9, 0x3e, 0x00 },
+        &.{ 0xfa, 0x3f, 0xc0, 0x00, 0x00 },
+        &.{ 0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 },
+    };
+    for (cases) |bytes| {
+        const item = try serde.deserialize(bytes, DataItem);
+        try std.testing.expect(item.float.value == 1.5);
+        const reencoded = try serde.serialize(item);
+        defer allocator.free(reencoded);
+        try std.testing.expectEqualSlices(u8, bytes, reencoded);
+    }
+}
+
+test "isWellFormed accepts exactly one complete item" {
+    try std.testing.expect(isWellFormed(&.{ 0xa1, 0x61, 'a', 0x82, 0x01, 0x02 }));
+    try std.testing.expect(isWellFormed(&.{ 0x5f, 0x41, 0x00, 0x41, 0x01, 0xff }));
+    try std.testing.expect(isWellFormed(&.{ 0xd8, 0x18, 0x41, 0x00 }));
+
+    try std.testing.expect(!isWellFormed(&.{}));
+    try std.testing.expect(!isWellFormed(&.{ 0xa1, 0x61, 'a', 0x82, 0x01 }));
+    try std.testing.expect(!isWellFormed(&.{ 0x19, 0x01 }));
+    try std.testing.expect(!isWellFormed(&.{ 0x82, 0x01, 0x02, 0x00 }));
+    try std.testing.expect(!isWellFormed(&.{ 0x61, 'a', 0xff }));
+    try std.testing.expect(!isWellFormed(&.{0x1c}));
+    try std.testing.expect(!isWellFormed(&.{ 0xf8, 0x00 }));
+    try std.testing.expect(!isWellFormed(&.{ 0xf8, 0x1f }));
+    try std.testing.expect(isWellFormed(&.{ 0xf8, 0x20 }));
+}
+
+test "serialize array hash map in insertion order" {
+    const allocator = std.testing.allocator;
+    var map = std.StringArrayHashMap(u8).init(allocator);
+    defer map.deinit();
+    try map.put("zz", 1);
+    try map.put("a", 2);
+    try map.put("mm", 3);
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(map);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa3,
+        0x62, 'z', 'z', 0x01,
+        0x61, 'a', 0x02,
+        0x62, 'm', 'm', 0x03,
+    }, serialized);
+
+    var deterministic = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer deterministic.deinit();
+    const sorted = try deterministic.serialize(map);
+    defer allocator.free(sorted);
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa3,
+        0x61, 'a', 0x02,
+        0x62, 'm', 'm', 0x03,
+        0x62, 'z', 'z', 0x01,
+    }, sorted);
+
+    const decoded = try serde.deserialize(serialized, std.StringArrayHashMap(u8));
+    try std.testing.expectEqualStrings("zz", decoded.keys()[0]);
+    try std.testing.expectEqualStrings("mm", decoded.keys()[2]);
+    try std.testing.expect(decoded.get("a").? == 2);
+}
+
+test "capture sub-map as raw cbor and decode it later" {
+    const allocator = std.testing.allocator;
+    const Limits = struct {
+        max_users: u32,
+        regions: []const []const u8,
+    };
+    const Settings = struct {
+        name: []const u8,
+        limits: Limits,
+    };
+    const LazySettings = struct {
+        name: []const u8,
+        limits: RawCbor,
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const original = Settings{
+        .name = "prod",
+        .limits = .{ .max_users = 500, .regions = &.{ "eu", "us" } },
+    };
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+
+    const lazy = try serde.deserialize(serialized, LazySettings);
+    try std.testing.expectEqualStrings("prod", lazy.name);
+    try std.testing.expect(lazy.limits.bytes[0] == 0xa2);
+
+    const limits = try lazy.limits.decode(&serde, Limits);
+    try std.testing.expect(limits.max_users == 500);
+    try std.testing.expectEqualStrings("us", limits.regions[1]);
+
+    const reserialized = try serde.serialize(lazy);
+    defer allocator.free(reserialized);
+    try std.testing.expectEqualSlices(u8, serialized, reserialized);
+}
+
+test "on_non_minimal reports offsets without failing" {
+    const allocator = std.testing.allocator;
+    const Recorder = struct {
+        offsets: [4]usize = undefined,
+        count: usize = 0,
+
+        fn record(context: ?*anyopaque, offset: usize) void {
+            const self: *@This() = @ptrCast(@alignCast(context.?));
+            self.offsets[self.count] = offset;
+            self.count += 1;
+        }
+    };
+
+    // [5 as 0x18 05, 16 as 0x19 0010, 32 as 0x18 20]
+    const bytes = &.{ 0x83, 0x18, 0x05, 0x19, 0x00, 0x10, 0x18, 0x20 };
+
+    var recorder = Recorder{};
+    var serde = Serde.init(allocator, .{ .decode = .{
+        .on_non_minimal = .{ .context = &recorder, .func = Recorder.record },
+    } });
+    defer serde.deinit();
+
+    const decoded = try serde.deserialize(bytes, []u32);
+    try std.testing.expectEqualSlices(u32, &.{ 5, 16, 32 }, decoded);
+    try std.testing.expect(recorder.count == 2);
+    try std.testing.expectEqualSlices(usize, &.{ 1, 3 }, recorder.offsets[0..recorder.count]);
+
+    // Skipped values are checked as well.
+    recorder.count = 0;
+    _ = try serde.deserialize(&.{ 0xa1, 0x61, 'x', 0x98, 0x01, 0x00 }, struct { y: ?u8 = null });
+    try std.testing.expect(recorder.count == 1);
+    try std.testing.expect(recorder.offsets[0] == 3);
+}
+
+test "encode std.json.Value matches fromJson" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var tags = std.json.Array.init(allocator);
+    defer tags.deinit();
+    try tags.append(.{ .string = "a" });
+    try tags.append(.{ .float = 1.5 });
+    try tags.append(.null);
+
+    var object = std.json.ObjectMap.init(allocator);
+    defer object.deinit();
+    try object.put("zeta", .{ .integer = -2 });
+    try object.put("alpha", .{ .bool = true });
+    try object.put("tags", .{ .array = tags });
+
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer() };
+    try encoder.encodeJsonValue(.{ .object = object });
+
+    const from_text = try serde.fromJson(
+        \\{"zeta": -2, "alpha": true, "tags": ["a", 1.5, null]}
+    );
+    defer allocator.free(from_text);
+
+    try std.testing.expectEqualSlices(u8, from_text, buffer.items);
+    // Key order follows the object, not sorted order.
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x64, 'z', 'e', 't', 'a', 0x21 }, buffer.items[0..7]);
+
+    try std.testing.expectError(error.InvalidJson, serde.fromJson("{"));
+}
+
+test "narrowing integer decodes are range checked" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const Case = struct { bytes: []const u8, ok: bool };
+    const u8_cases = [_]Case{
+        .{ .bytes = &.{ 0x18, 0xff }, .ok = true }, // 255
+        .{ .bytes = &.{ 0x19, 0x01, 0x00 }, .ok = false }, // 256
+        .{ .bytes = &.{ 0x19, 0x01, 0x2c }, .ok = false }, // 300
+        .{ .bytes = &.{0x20}, .ok = false }, // -1
+    };
+    const i8_cases = [_]Case{
+        .{ .bytes = &.{ 0x18, 0x7f }, .ok = true }, // 127
+        .{ .bytes = &.{ 0x18, 0x80 }, .ok = false }, // 128
+        .{ .bytes = &.{ 0x38, 0x7f }, .ok = true }, // -128
+        .{ .bytes = &.{ 0x38, 0x80 }, .ok = false }, // -129
+    };
+    const u32_cases = [_]Case{
+        .{ .bytes = &.{ 0x1a, 0xff, 0xff, 0xff, 0xff }, .ok = true },
+        .{ .bytes = &.{ 0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00 }, .ok = false },
+        .{ .bytes = &.{ 0x3a, 0x00, 0x00, 0x00, 0x00 }, .ok = false }, // -1
+    };
+    const i64_cases = [_]Case{
+        .{ .bytes = &.{ 0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }, .ok = true },
+        .{ .bytes = &.{ 0x1b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 }, .ok = false },
+        .{ .bytes = &.{ 0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }, .ok = true }, // minInt(i64)
+        .{ .bytes = &.{ 0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 }, .ok = false },
+    };
+
+    inline for (.{ .{ u8, &u8_cases }, .{ i8, &i8_cases }, .{ u32, &u32_cases }, .{ i64, &i64_cases } }) |entry| {
+        for (entry[1]) |case| {
+            const result = serde.deserialize(case.bytes, entry[0]);
+            if (case.ok) {
+                _ = try result;
+            } else {
+                try std.testing.expectError(error.IntegerOutOfRange, result);
+            }
+        }
+    }
+
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x61, 'a' }, u8));
+}
+
+test "diagnostic notation with byte offset annotations" {
+    const allocator = std.testing.allocator;
+    const bytes = &.{ 0x83, 0x01, 0x61, 'a', 0xa1, 0x20, 0xf9, 0x3e, 0x00 };
+
+    const plain = try toDiagnostic(allocator, bytes);
+    defer allocator.free(plain);
+    try std.testing.expectEqualStrings("[1, \"a\", {-1: 1.5}]", plain);
+
+    const annotated = try toAnnotatedDiagnostic(allocator, bytes);
+    defer allocator.free(annotated);
+    try std.testing.expectEqualStrings(
+        \\# 0x00: array(3)
+        \\[
+        \\  # 0x01: unsigned(1)
+        \\  1,
+        \\  # 0x02: text(1)
+        \\  "a",
+        \\  # 0x04: map(1)
+        \\  {
+        \\    # 0x05: negative(0)
+        \\    -1:
+        \\    # 0x06: float16
+        \\    1.5
+        \\  }
+        \\]
+        \\
+    , annotated);
+}
+
+test "tagged bignums decode into native integers" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // 2(h'0100000000000000000000000000000000') is 2^128 - too big for u128.
+    const too_big = [_]u8{ 0xc2, 0x51, 0x01 } ++ [_]u8{0} ** 16;
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&too_big, u128));
+
+    // 2(h'010000000000000000') is 2^64.
+    const two_64 = [_]u8{ 0xc2, 0x49, 0x01 } ++ [_]u8{0} ** 8;
+    try std.testing.expect(try serde.deserialize(&two_64, u128) == 1 << 64);
+    try std.testing.expect(try serde.deserialize(&two_64, i128) == 1 << 64);
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&two_64, u64));
+
+    const max_u128 = [_]u8{ 0xc2, 0x50 } ++ [_]u8{0xff} ** 16;
+    try std.testing.expect(try serde.deserialize(&max_u128, u128) == std.math.maxInt(u128));
+
+    // 3(h'010000000000000000') is -1 - 2^64.
+    const neg = [_]u8{ 0xc3, 0x49, 0x01 } ++ [_]u8{0} ** 8;
+    try std.testing.expect(try serde.deserialize(&neg, i128) == -1 - (1 << 64));
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&neg, u128));
+
+    // Untagged integers still decode as before.
+    try std.testing.expect(try serde.deserialize(&.{ 0x18, 0x2a }, u128) == 42);
+}
+
+test "round trip a list of strings" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const names: []const []const u8 = &.{ "", "a", "hello", "x" ** 30 };
+    const serialized = try serde.serialize(names);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0x84, 0x40, 0x41, 'a' }, serialized[0..4]);
+
+    const decoded = try serde.deserialize(serialized, [][]const u8);
+    try std.testing.expect(decoded.len == names.len);
+    for (names, decoded) |want, got| try std.testing.expectEqualStrings(want, got);
+
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer() };
+    try encoder.encodeStringArray(names[0..3]);
+    try std.testing.expectEqualSlices(u8, &.{ 0x83, 0x60, 0x61, 'a', 0x65, 'h', 'e', 'l', 'l', 'o' }, buffer.items);
+    try std.testing.expect((try serde.deserialize(buffer.items, [][]u8)).len == 3);
+}
+
+test "empty input as null or zero value" {
+    const allocator = std.testing.allocator;
+    const Reply = struct { code: u16, message: []const u8 };
+
+    var strict = Serde.init(allocator, .{});
+    defer strict.deinit();
+    try std.testing.expectError(error.EndOfStream, strict.deserialize(&.{}, ?Reply));
+
+    var lenient = Serde.init(allocator, .{ .decode = .{ .empty_as_null = true } });
+    defer lenient.deinit();
+    try std.testing.expect(try lenient.deserialize(&.{}, ?Reply) == null);
+
+    const reply = try lenient.deserialize(&.{}, Reply);
+    try std.testing.expect(reply.code == 0);
+    try std.testing.expect(reply.message.len == 0);
+    try std.testing.expect(try lenient.deserialize(&.{}, u32) == 0);
+
+    // Field defaults win, so pointers only need one.
+    const fallback: u8 = 7;
+    const Session = struct {
+        retries: u8 = 3,
+        parent: *const u8 = &fallback,
+        inner: struct { label: []const u8 = "none", next: ?*const u8 },
+    };
+    const session = try lenient.deserialize(&.{}, Session);
+    try std.testing.expect(session.retries == 3);
+    try std.testing.expect(session.parent.* == 7);
+    try std.testing.expectEqualStrings("none", session.inner.label);
+    try std.testing.expect(session.inner.next == null);
+
+    const decoded = try decodeWithOptions(allocator, Session, &.{}, .{ .empty_as_null = true });
+    defer decoded.deinit();
+    try std.testing.expect(decoded.value.retries == 3);
+}
+
+test "deterministic sort orders integer keys by length then bytes" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer serde.deinit();
+
+    const pairs = [_]DataItem.Pair{
+        .{ .key = .{ .uint = 24 }, .value = .{ .uint = 4 } },
+        .{ .key = .{ .uint = 2 }, .value = .{ .uint = 2 } },
+        .{ .key = .{ .uint = 23 }, .value = .{ .uint = 3 } },
+        .{ .key = .{ .uint = 1 }, .value = .{ .uint = 1 } },
+    };
+    const serialized = try serde.serialize(DataItem{ .map = &pairs });
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa4, 0x01, 0x01, 0x02, 0x02, 0x17, 0x03, 0x18, 0x18, 0x04 }, serialized);
+
+    // Equal keys are left in their original order.
+    const dupes = [_]DataItem.Pair{
+        .{ .key = .{ .uint = 1 }, .value = .{ .bool = true } },
+        .{ .key = .{ .uint = 0 }, .value = .null },
+        .{ .key = .{ .uint = 1 }, .value = .{ .bool = false } },
+    };
+    const serialized_dupes = try serde.serialize(DataItem{ .map = &dupes });
+    defer allocator.free(serialized_dupes);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x00, 0xf6, 0x01, 0xf5, 0x01, 0xf4 }, serialized_dupes);
+}
+
+test "nested optional keeps absent, null and empty apart" {
+    const allocator = std.testing.allocator;
+    const Record = struct { id: u8, blob: ??[]const u8 };
+    var serde = Serde.init(allocator, .{ .encode = .{ .omit_null_fields = true } });
+    defer serde.deinit();
+
+    const absent = try serde.serialize(Record{ .id = 1, .blob = null });
+    defer allocator.free(absent);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x62, 'i', 'd', 0x01 }, absent);
+    try std.testing.expect((try serde.deserialize(absent, Record)).blob == null);
+
+    const present_null = try serde.serialize(Record{ .id = 1, .blob = @as(?[]const u8, null) });
+    defer allocator.free(present_null);
+    try std.testing.expectEqualSlices(u8, &.{ 0xf6 }, present_null[present_null.len - 1 ..]);
+    const decoded_null = try serde.deserialize(present_null, Record);
+    try std.testing.expect(decoded_null.blob != null and decoded_null.blob.? == null);
+
+    const empty = try serde.serialize(Record{ .id = 1, .blob = @as(?[]const u8, "") });
+    defer allocator.free(empty);
+    try std.testing.expectEqualSlices(u8, &.{ 0x40 }, empty[empty.len - 1 ..]);
+    const decoded_empty = try serde.deserialize(empty, Record);
+    try std.testing.expect(decoded_empty.blob.?.?.len == 0);
+}
+
+test "odd-width integers use the shortest fitting encoding" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const max_u24 = try serde.serialize(@as(u24, std.math.maxInt(u24)));
+    defer allocator.free(max_u24);
+    try std.testing.expectEqualSlices(u8, &.{ 0x1a, 0x00, 0xff, 0xff, 0xff }, max_u24);
+    try std.testing.expect(try serde.deserialize(max_u24, u24) == std.math.maxInt(u24));
+
+    const small = try serde.serialize(@as(u24, 200));
+    defer allocator.free(small);
+    try std.testing.expectEqualSlices(u8, &.{ 0x18, 0xc8 }, small);
+
+    const min_i40 = try serde.serialize(@as(i40, std.math.minInt(i40)));
+    defer allocator.free(min_i40);
+    try std.testing.expectEqualSlices(u8, &.{ 0x3b, 0x00, 0x00, 0x00, 0x7f, 0xff, 0xff, 0xff, 0xff }, min_i40);
+    try std.testing.expect(try serde.deserialize(min_i40, i40) == std.math.minInt(i40));
+
+    // 2^24 does not fit.
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&.{ 0x1a, 0x01, 0x00, 0x00, 0x00 }, u24));
+}
+
+test "checkpoint and resume a sequence" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // 1, "two", [3]
+    const bytes = &.{ 0x01, 0x63, 't', 'w', 'o', 0x81, 0x03 };
+    var dec = serde.sequenceDecoder(bytes);
+    try std.testing.expect(try serde.deserializeNext(&dec, u8) == 1);
+    const checkpoint = dec.offset();
+    try std.testing.expect(checkpoint == 1);
+    try std.testing.expect(dec.remaining() == 6);
+
+    try std.testing.expectEqualStrings("two", try serde.deserializeNext(&dec, []const u8));
+    try dec.seek(checkpoint);
+    try std.testing.expectEqualStrings("two", try serde.deserializeNext(&dec, []const u8));
+    try std.testing.expectEqualSlices(u32, &.{3}, try serde.deserializeNext(&dec, []u32));
+    try std.testing.expect(dec.remaining() == 0);
+    try std.testing.expectError(error.EndOfStream, dec.seek(bytes.len + 1));
+}
+
+test "struct decode dispatches keys through the field table" {
+    const allocator = std.testing.allocator;
+    const Wide = struct {
+        a: u8,
+        ab: u8,
+        abc: u8,
+        b: u8,
+        ba: u8,
+        longer_name: []const u8,
+        longer_namf: bool,
+    };
+    var serde = Serde.init(allocator, .{ .decode = .{ .reject_duplicate_keys = true } });
+    defer serde.deinit();
+
+    const original = Wide{ .a = 1, .ab = 2, .abc = 3, .b = 4, .ba = 5, .longer_name = "x", .longer_namf = true };
+    const serialized = try serde.serialize(original);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualDeep(original, try serde.deserialize(serialized, Wide));
+
+    // {"ba": 5, "zz": 0, "a": 1} - unknown key skipped, remaining fields missing.
+    const partial = &.{ 0xa3, 0x62, 'b', 'a', 0x05, 0x62, 'z', 'z', 0x00, 0x61, 'a', 0x01 };
+    try std.testing.expectError(error.MissingRequiredField, serde.deserialize(partial, Wide));
+    const Partial = struct { a: u8, ba: u8, b: ?u8 = null };
+    const decoded = try serde.deserialize(partial, Partial);
+    try std.testing.expect(decoded.a == 1 and decoded.ba == 5 and decoded.b == null);
+
+    const dupe = &.{ 0xa2, 0x61, 'a', 0x01, 0x61, 'a', 0x02 };
+    try std.testing.expectError(error.DuplicateKey, serde.deserialize(dupe, Partial));
+}
+
+test "text strings must be strict utf-8" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // '/' as the overlong two-byte sequence c0 af.
+    const overlong = &.{ 0x62, 0xc0, 0xaf };
+    try std.testing.expectError(error.InvalidUtf8, serde.deserialize(overlong, []const u8));
+    try std.testing.expectError(error.InvalidUtf8, serde.deserialize(overlong, DataItem));
+
+    // U+D800 encoded as ed a0 80.
+    const surrogate = &.{ 0x63, 0xed, 0xa0, 0x80 };
+    try std.testing.expectError(error.InvalidUtf8, serde.deserialize(surrogate, []const u8));
+    try std.testing.expectError(error.InvalidUtf8, serde.deserialize(surrogate, DataItem));
+
+    // The same bytes are fine in a byte string.
+    try std.testing.expectEqualSlices(u8, &.{ 0xed, 0xa0, 0x80 }, try serde.deserialize(&.{ 0x43, 0xed, 0xa0, 0x80 }, []const u8));
+    try std.testing.expectEqualStrings("é", try serde.deserialize(&.{ 0x62, 0xc3, 0xa9 }, []const u8));
+}
+
+test "decode struct from an array of key/value pairs" {
+    const allocator = std.testing.allocator;
+    const Point = struct { a: u8, b: u8 };
+    var serde = Serde.init(allocator, .{ .decode = .{ .accept_pair_arrays = true } });
+    defer serde.deinit();
+
+    // [["a", 1], ["b", 2]]
+    const pairs = &.{ 0x82, 0x82, 0x61, 'a', 0x01, 0x82, 0x61, 'b', 0x02 };
+    try std.testing.expectEqual(Point{ .a = 1, .b = 2 }, try serde.deserialize(pairs, Point));
+
+    // [["a", 1, 3], ["b", 2]]
+    const bad = &.{ 0x82, 0x83, 0x61, 'a', 0x01, 0x03, 0x82, 0x61, 'b', 0x02 };
+    try std.testing.expectError(error.InvalidPairArray, serde.deserialize(bad, Point));
+
+    var strict = Serde.init(allocator, .{});
+    defer strict.deinit();
+    try std.testing.expectError(error.TypeMismatch, strict.deserialize(pairs, Point));
+}
+
+test "encodeHead and decodeHead across width boundaries" {
+    const allocator = std.testing.allocator;
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+
+    const Case = struct { value: u64, len: usize };
+    const cases = [_]Case{
+        .{ .value = 0, .len = 1 },
+        .{ .value = 23, .len = 1 },
+        .{ .value = 24, .len = 2 },
+        .{ .value = 255, .len = 2 },
+        .{ .value = 256, .len = 3 },
+        .{ .value = 65535, .len = 3 },
+        .{ .value = 65536, .len = 5 },
+        .{ .value = std.math.maxInt(u32), .len = 5 },
+        .{ .value = std.math.maxInt(u32) + 1, .len = 9 },
+        .{ .value = std.math.maxInt(u64), .len = 9 },
+    };
+    for (0..8) |m| {
+        const major: u3 = @intCast(m);
+        for (cases) |case| {
+            buffer.clearRetainingCapacity();
+            try encodeHead(buffer.writer(), major, case.value);
+            try std.testing.expect(buffer.items.len == case.len);
+            try std.testing.expect(buffer.items[0] >> 5 == major);
+
+            var stream = std.io.fixedBufferStream(@as([]const u8, buffer.items));
+            const head = try decodeHead(stream.reader());
+            try std.testing.expectEqual(Head{ .major = major, .arg = case.value, .indefinite = false }, head);
+        }
+    }
+
+    var stream = std.io.fixedBufferStream(@as([]const u8, &.{ 0x9f, 0xff, 0x1f }));
+    try std.testing.expectEqual(Head{ .major = 4, .arg = 0, .indefinite = true }, try decodeHead(stream.reader()));
+    try std.testing.expectEqual(Head{ .major = 7, .arg = 0, .indefinite = true }, try decodeHead(stream.reader()));
+    try std.testing.expectError(error.InvalidAdditionalInfo, decodeHead(stream.reader()));
+}
+
+test "max_nodes bounds recursive pointer decodes" {
+    const allocator = std.testing.allocator;
+    const Node = struct {
+        value: u32,
+        next: ?*const @This() = null,
+    };
+
+    var nodes: [20]Node = undefined;
+    for (&nodes, 0..) |*node, i| {
+        node.* = .{ .value = @intCast(i), .next = if (i + 1 < nodes.len) &nodes[i + 1] else null };
+    }
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(nodes[0]);
+    defer allocator.free(serialized);
+
+    var count: u32 = 0;
+    const head = try serde.deserialize(serialized, Node);
+    var cursor: ?*const Node = &head;
+    while (cursor) |node| : (cursor = node.next) {
+        try std.testing.expect(node.value == count);
+        count += 1;
+    }
+    try std.testing.expect(count == nodes.len);
+
+    var limited = Serde.init(allocator, .{ .decode = .{ .max_nodes = 10 } });
+    defer limited.deinit();
+    try std.testing.expectError(error.TooManyNodes, limited.deserialize(serialized, Node));
+}
+
+test "hex round trip" {
+    const allocator = std.testing.allocator;
+    const Pair = struct { a: u8, b: []const u8 };
+
+    const hex = try encodeToHex(allocator, Pair{ .a = 1, .b = "hi" });
+    defer allocator.free(hex);
+    try std.testing.expectEqualStrings("a26161016162426869", hex);
+
+    const decoded = try decodeFromHex(allocator, Pair, hex);
+    defer decoded.deinit();
+    try std.testing.expect(decoded.value.a == 1);
+    try std.testing.expectEqualStrings("hi", decoded.value.b);
+
+    const upper = try decodeFromHex(allocator, u16, "1903E8");
+    defer upper.deinit();
+    try std.testing.expect(upper.value == 1000);
+
+    try std.testing.expectError(error.InvalidHex, decodeFromHex(allocator, u8, "190"));
+    try std.testing.expectError(error.InvalidHex, decodeFromHex(allocator, u8, "zz"));
+}
+
+test "enum names decode through a static map" {
+    const allocator = std.testing.allocator;
+    const Color = enum(u8) { red = 1, green = 5, blue, light_blue };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    try std.testing.expect(try serde.deserialize(&.{ 0x64, 'b', 'l', 'u', 'e' }, Color) == .blue);
+    try std.testing.expect(try serde.deserialize(&.{ 0x6a, 'l', 'i', 'g', 'h', 't', '_', 'b', 'l', 'u', 'e' }, Color) == .light_blue);
+    try std.testing.expect(try serde.deserialize(&.{0x05}, Color) == .green);
+    try std.testing.expectError(error.InvalidEnumTag, serde.deserialize(&.{ 0x64, 'p', 'i', 'n', 'k' }, Color));
+    try std.testing.expectError(error.InvalidEnumTag, serde.deserialize(&.{ 0x63, 'r', 'e', 'D' }, Color));
+}
+
+test "booleans as integers" {
+    const allocator = std.testing.allocator;
+    const Flags = struct { on: bool, off: bool };
+
+    var int_serde = Serde.init(allocator, .{ .encode = .{ .bool_as_int = true }, .decode = .{ .int_bools = true } });
+    defer int_serde.deinit();
+    const serialized = try int_serde.serialize(Flags{ .on = true, .off = false });
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa2, 0x62, 'o', 'n', 0x01, 0x63, 'o', 'f', 'f', 0x00 }, serialized);
+    try std.testing.expectEqual(Flags{ .on = true, .off = false }, try int_serde.deserialize(serialized, Flags));
+    try std.testing.expect(try int_serde.deserialize(&.{0xf5}, bool));
+    try std.testing.expectError(error.TypeMismatch, int_serde.deserialize(&.{0x02}, bool));
+
+    var strict = Serde.init(allocator, .{});
+    defer strict.deinit();
+    try std.testing.expectError(error.TypeMismatch, strict.deserialize(serialized, Flags));
+    const proper = try strict.serialize(true);
+    defer allocator.free(proper);
+    try std.testing.expectEqualSlices(u8, &.{0xf5}, proper);
+}
+
+test "decode a mixed-value map into StringHashMap(DataItem)" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // {"n": 7, "s": "hi", "list": [1, {"k": null}]}
+    const bytes = &.{
+        0xa3,
+        0x61, 'n', 0x07,
+        0x61, 's', 0x62, 'h', 'i',
+        0x64, 'l', 'i', 's', 't', 0x82, 0x01, 0xa1, 0x61, 'k', 0xf6,
+    };
+    const map = try serde.deserialize(bytes, std.StringHashMap(DataItem));
+    try std.testing.expect(map.count() == 3);
+    try std.testing.expect(map.get("n").?.uint == 7);
+    try std.testing.expectEqualStrings("hi", map.get("s").?.text);
+
+    const list = map.get("list").?.array;
+    try std.testing.expect(list.len == 2);
+    try std.testing.expect(list[0].uint == 1);
+    try std.testing.expectEqualStrings("k", list[1].map[0].key.text);
+    try std.testing.expect(list[1].map[0].value == .null);
+
+    // Everything is owned by the serde arena and freed by `deinit`.
+    const reencoded = try serde.serialize(map.get("list").?);
+    defer allocator.free(reencoded);
+    try std.testing.expectEqualSlices(u8, bytes[14..], reencoded);
+}
+
+test "stream cbor to json" {
+    const allocator = std.testing.allocator;
+
+    // {"a": [1, -2, 1.5], 3: h'fffe', "t": 1(true), "s": (_ "x", "y"), "n": null}
+    const bytes = &.{
+        0xa5,
+        0x61, 'a', 0x83, 0x01, 0x21, 0xf9, 0x3e, 0x00,
+        0x03, 0x42, 0xff, 0xfe,
+        0x61, 't', 0xc1, 0xf5,
+        0x61, 's', 0x7f, 0x61, 'x', 0x61, 'y', 0xff,
+        0x61, 'n', 0xf6,
+    };
+    const json = try toJson(allocator, bytes);
+    defer allocator.free(json);
+    try std.testing.expectEqualStrings("{\"a\":[1,-2,1.5],\"3\":\"__4\",\"t\":true,\"s\":\"xy\",\"n\":null}", json);
+
+    // An indefinite array of 0..9999 streamed into a counting writer.
+    var large = std.ArrayList(u8).init(allocator);
+    defer large.deinit();
+    try large.append(0x9f);
+    for (0..10000) |i| try encodeHead(large.writer(), 0, i);
+    try large.append(0xff);
+
+    var counting = std.io.countingWriter(std.io.null_writer);
+    try writeJson(counting.writer(), large.items);
+    // Digits of 0..9999, 9999 commas and two brackets.
+    try std.testing.expect(counting.bytes_written == 10 + 90 * 2 + 900 * 3 + 9000 * 4 + 9999 + 2);
+}
+
+test "nested tags keep their order through DataItem" {
+    const allocator = std.testing.allocator;
+    // 6(5(100(h'01')))
+    const bytes = &.{ 0xc6, 0xc5, 0xd8, 0x64, 0x41, 0x01 };
+
+    inline for (.{ false, true }) |deterministic| {
+        var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = deterministic } });
+        defer serde.deinit();
+
+        const item = try serde.deserialize(bytes, DataItem);
+        try std.testing.expect(item.tag.number == 6);
+        try std.testing.expect(item.tag.content.tag.number == 5);
+        try std.testing.expect(item.tag.content.tag.content.tag.number == 100);
+
+        const reencoded = try serde.serialize(item);
+        defer allocator.free(reencoded);
+        try std.testing.expectEqualSlices(u8, bytes, reencoded);
+    }
+}
+
+test "sort_keys_by orders keys without the deterministic profile" {
+    const allocator = std.testing.allocator;
+    const Keys = struct { bb: u8, a: u8, c: f64 };
+    const value = Keys{ .bb = 1, .a = 2, .c = 1.5 };
+
+    var unsorted = Serde.init(allocator, .{});
+    defer unsorted.deinit();
+    const as_declared = try unsorted.serialize(value);
+    defer allocator.free(as_declared);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x62, 'b', 'b', 0x01, 0x61, 'a', 0x02, 0x61, 'c', 0xfb }, as_declared[0..11]);
+
+    // "bb" (0x62...) sorts after "a" and "c" (0x61...) either way, and the
+    // float keeps its full width.
+    var bytewise = Serde.init(allocator, .{ .encode = .{ .sort_keys_by = .bytewise } });
+    defer bytewise.deinit();
+    const sorted = try bytewise.serialize(value);
+    defer allocator.free(sorted);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x61, 'a', 0x02, 0x61, 'c', 0xfb }, sorted[0..7]);
+    try std.testing.expectEqualSlices(u8, &.{ 0x62, 'b', 'b', 0x01 }, sorted[sorted.len - 4 ..]);
+
+    // Mixed key types tell the two orders apart: -1 (0x20) against "a" (0x61 0x61) and 24 (0x18 0x18).
+    const pairs = [_]DataItem.Pair{
+        .{ .key = .{ .text = "a" }, .value = .null },
+        .{ .key = .{ .uint = 24 }, .value = .null },
+        .{ .key = .{ .nint = 0 }, .value = .null },
+    };
+    const map = DataItem{ .map = &pairs };
+
+    const bytewise_map = try bytewise.serialize(map);
+    defer allocator.free(bytewise_map);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x18, 0x18, 0xf6, 0x20, 0xf6, 0x61, 'a', 0xf6 }, bytewise_map);
+
+    var length_first = Serde.init(allocator, .{ .encode = .{ .sort_keys_by = .length_first } });
+    defer length_first.deinit();
+    const length_first_map = try length_first.serialize(map);
+    defer allocator.free(length_first_map);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x20, 0xf6, 0x18, 0x18, 0xf6, 0x61, 'a', 0xf6 }, length_first_map);
+}
+
+test "decodeFields marks the fields present in a map" {
+    const allocator = std.testing.allocator;
+    const Account = struct {
+        id: u32,
+        name: []const u8,
+        email: ?[]const u8 = null,
+        roles: []const []const u8 = &.{},
+    };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // {"name": "x", "extra": 1, "id": 7}
+    const bytes = &.{ 0xa3, 0x64, 'n', 'a', 'm', 'e', 0x61, 'x', 0x65, 'e', 'x', 't', 'r', 'a', 0x01, 0x62, 'i', 'd', 0x07 };
+    const fields = try serde.decodeFields(bytes, Account);
+    try std.testing.expect(fields.get(.id).?.uint == 7);
+    try std.testing.expectEqualStrings("x", fields.get(.name).?.text);
+    try std.testing.expect(fields.get(.email) == null);
+    try std.testing.expect(fields.get(.roles) == null);
+}
+
+test "string literals are text, byte slices and arrays are bytes" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const literal = try serde.serialize("abc");
+    defer allocator.free(literal);
+    try std.testing.expectEqualSlices(u8, &.{ 0x63, 'a', 'b', 'c' }, literal);
+
+    const slice: []const u8 = "abc";
+    const from_slice = try serde.serialize(slice);
+    defer allocator.free(from_slice);
+    try std.testing.expectEqualSlices(u8, &.{ 0x43, 'a', 'b', 'c' }, from_slice);
+
+    const array = [3]u8{ 'a', 'b', 'c' };
+    const from_array = try serde.serialize(array);
+    defer allocator.free(from_array);
+    try std.testing.expectEqualSlices(u8, &.{ 0x43, 'a', 'b', 'c' }, from_array);
+    try std.testing.expectEqual(array, try serde.deserialize(from_array, [3]u8));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(from_array, [4]u8));
+
+    const numbers = try serde.serialize([2]u16{ 1, 500 });
+    defer allocator.free(numbers);
+    try std.testing.expectEqualSlices(u8, &.{ 0x82, 0x01, 0x19, 0x01, 0xf4 }, numbers);
+    try std.testing.expectEqual([2]u16{ 1, 500 }, try serde.deserialize(numbers, [2]u16));
+}
+
+test "reset reuses the encoder buffer" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer() };
+
+    try serde.serializeInto(&encoder, [_]u32{ 1, 2, 3 });
+    try std.testing.expectEqualSlices(u8, &.{ 0x83, 0x01, 0x02, 0x03 }, encoder.finish());
+    const capacity = buffer.capacity;
+
+    encoder.reset();
+    try serde.serializeInto(&encoder, @as(u8, 7));
+    try std.testing.expectEqualSlices(u8, &.{0x07}, encoder.finish());
+    try std.testing.expect(buffer.capacity == capacity);
+}
+
+test "tag 1 timestamps to nanoseconds" {
+    // 1(1.5) as float16
+    try std.testing.expect(try decodeEpochNanos(&.{ 0xc1, 0xf9, 0x3e, 0x00 }) == 1_500_000_000);
+    // 1(-1.5) as float64
+    try std.testing.expect(try decodeEpochNanos(&.{ 0xc1, 0xfb, 0xbf, 0xf8, 0, 0, 0, 0, 0, 0 }) == -1_500_000_000);
+    // 1(1700000000.123456789); the nearest f64 is 1700000000.12345671653747...
+    try std.testing.expect(try decodeEpochNanos(&.{ 0xc1, 0xfb, 0x41, 0xd9, 0x54, 0xfc, 0x40, 0x07, 0xe6, 0xb7 }) == 1_700_000_000_123_456_717);
+    // 1(1700000000)
+    try std.testing.expect(try decodeEpochNanos(&.{ 0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00 }) == 1_700_000_000 * std.time.ns_per_s);
+
+    try std.testing.expectError(error.TypeMismatch, decodeEpochNanos(&.{ 0xc0, 0x00 }));
+    try std.testing.expectError(error.IntegerOutOfRange, decodeEpochNanos(&.{ 0xc1, 0xf9, 0x7c, 0x00 }));
+}
+
+test "SimpleValue fields capture simple values" {
+    const allocator = std.testing.allocator;
+    const Frame = struct { kind: SimpleValue, len: u8 };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // {"kind": simple(16), "len": 2}
+    const bytes = &.{ 0xa2, 0x64, 'k', 'i', 'n', 'd', 0xf0, 0x63, 'l', 'e', 'n', 0x02 };
+    const frame = try serde.deserialize(bytes, Frame);
+    try std.testing.expect(frame.kind.value == 16);
+
+    const serialized = try serde.serialize(frame);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, bytes, serialized);
+
+    try std.testing.expect((try serde.deserialize(&.{ 0xf8, 0xff }, SimpleValue)).value == 255);
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{0x10}, SimpleValue));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0xf9, 0x3e, 0x00 }, SimpleValue));
+    try std.testing.expectError(error.InvalidAdditionalInfo, serde.deserialize(&.{ 0xf8, 0x10 }, SimpleValue));
+}
+
+test "decode a window of a large array" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // 100 elements, each [i, "x"] so that skipping has to step over nested items.
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    try encodeHead(buffer.writer(), 4, 100);
+    for (0..100) |i| {
+        try encodeHead(buffer.writer(), 4, 2);
+        try encodeHead(buffer.writer(), 0, i);
+        try encodeHead(buffer.writer(), 3, 1);
+        try buffer.append('x');
+    }
+
+    const window = try serde.decodePartialArray(buffer.items, DataItem, 10, 5);
+    try std.testing.expect(window.total == 100);
+    try std.testing.expect(window.items.len == 5);
+    for (window.items, 10..) |item, want| {
+        try std.testing.expect(item.array[0].uint == want);
+        try std.testing.expectEqualStrings("x", item.array[1].text);
+    }
+
+    const tail = try serde.decodePartialArray(buffer.items, DataItem, 98, 5);
+    try std.testing.expect(tail.items.len == 2 and tail.total == 100);
+}
+
+test "vectors round trip as arrays" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const v: @Vector(4, f32) = .{ 1.0, -2.5, 0.5, 8.0 };
+    const serialized = try serde.serialize(v);
+    defer allocator.free(serialized);
+    try std.testing.expect(serialized[0] == 0x84);
+    const decoded = try serde.deserialize(serialized, @Vector(4, f32));
+    try std.testing.expect(@reduce(.And, decoded == v));
+
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(serialized, @Vector(3, f32)));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(serialized, @Vector(5, f32)));
+}
+
+test "validateCollect reports several errors in a sequence" {
+    const allocator = std.testing.allocator;
+    // 1, <reserved 0x1c>, [2, 3], <stray break>, "a"
+    const bytes = &.{ 0x01, 0x1c, 0x82, 0x02, 0x03, 0xff, 0x61, 'a' };
+    const errors = try validateCollect(bytes, allocator);
+    defer allocator.free(errors);
+
+    try std.testing.expect(errors.len == 2);
+    try std.testing.expectEqual(ValidationError{ .offset = 1, .kind = error.InvalidAdditionalInfo }, errors[0]);
+    try std.testing.expectEqual(ValidationError{ .offset = 5, .kind = error.UnexpectedBreak }, errors[1]);
+
+    const clean = try validateCollect(&.{ 0x01, 0x02 }, allocator);
+    defer allocator.free(clean);
+    try std.testing.expect(clean.len == 0);
+}
+
+test "deterministic structs are sorted at comptime without allocating" {
+    const Mixed = struct {
+        zeta: u8,
+        alg: i8,
+        a: []const u8,
+        kind: u8,
+
+        pub const cbor_keys = .{ .alg = 3, .kind = -1 };
+    };
+    const value = Mixed{ .zeta = 1, .alg = -7, .a = "x", .kind = 2 };
+
+    var counting = @import("testing.zig").CountingAllocator.init(std.testing.allocator);
+    var serde = Serde.init(std.testing.allocator, .{ .encode = .{ .deterministic = true } });
+    defer serde.deinit();
+
+    var buffer = try std.ArrayList(u8).initCapacity(counting.allocator(), 64);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer(), .options = serde.config.encode };
+    const before = counting.allocations;
+    try serde.serializeInto(&encoder, value);
+    try std.testing.expect(counting.allocations == before);
+
+    // Same entries as a DataItem map, which is sorted at runtime.
+    const pairs = [_]DataItem.Pair{
+        .{ .key = .{ .text = "zeta" }, .value = .{ .uint = 1 } },
+        .{ .key = .{ .uint = 3 }, .value = .{ .nint = 6 } },
+        .{ .key = .{ .text = "a" }, .value = .{ .bytes = "x" } },
+        .{ .key = .{ .nint = 0 }, .value = .{ .uint = 2 } },
+    };
+    const runtime_sorted = try serde.serialize(DataItem{ .map = &pairs });
+    defer std.testing.allocator.free(runtime_sorted);
+    try std.testing.expectEqualSlices(u8, runtime_sorted, buffer.items);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa4, 0x03, 0x26, 0x20, 0x02, 0x61, 'a', 0x41, 'x' }, buffer.items[0..9]);
+
+    var length_first = Serde.init(std.testing.allocator, .{ .encode = .{ .sort_keys_by = .length_first } });
+    defer length_first.deinit();
+    const by_length = try length_first.serialize(value);
+    defer std.testing.allocator.free(by_length);
+    const runtime_by_length = try length_first.serialize(DataItem{ .map = &pairs });
+    defer std.testing.allocator.free(runtime_by_length);
+    try std.testing.expectEqualSlices(u8, runtime_by_length, by_length);
+}
+
+test "packed int arrays round trip" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var values = std.PackedIntArray(u3, 16).initAllTo(0);
+    for (0..16) |i| values.set(i, @intCast(i % 8));
+
+    const serialized = try serde.serialize(values);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0x90, 0x00, 0x01, 0x02, 0x03 }, serialized[0..5]);
+
+    const decoded = try serde.deserialize(serialized, std.PackedIntArray(u3, 16));
+    for (0..16) |i| try std.testing.expect(decoded.get(i) == values.get(i));
+
+    // 8 does not fit in a u3.
+    const bad = [_]u8{ 0x82, 0x01, 0x08 };
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&bad, std.PackedIntArray(u3, 2)));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x81, 0x01 }, std.PackedIntArray(u3, 2)));
+}
+
+test "types can stream their own encoding" {
+    const allocator = std.testing.allocator;
+    const Rope = struct {
+        segments: []const []const u8,
+
+        pub fn encodeCborStream(self: @This(), encoder: *Encoder) CborError!void {
+            try encoder.beginIndefiniteBytes();
+            for (self.segments) |segment| try encoder.encodeBytes(segment);
+            try encoder.encodeBreak();
+        }
+    };
+    const Document = struct { body: Rope };
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(Document{ .body = .{ .segments = &.{ "ab", "c" } } });
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x64, 'b', 'o', 'd', 'y', 0x5f, 0x42, 'a', 'b', 0x41, 'c', 0xff }, serialized);
+    try validate(serialized);
+}
+
+test "parse_stringified_numbers" {
+    const allocator = std.testing.allocator;
+    const Reading = struct { count: u32, value: f64 };
+
+    var serde = Serde.init(allocator, .{ .decode = .{ .parse_stringified_numbers = true } });
+    defer serde.deinit();
+    // {"count": "42", "value": "3.14"}
+    const bytes = &.{ 0xa2, 0x65, 'c', 'o', 'u', 'n', 't', 0x62, '4', '2', 0x65, 'v', 'a', 'l', 'u', 'e', 0x64, '3', '.', '1', '4' };
+    const reading = try serde.deserialize(bytes, Reading);
+    try std.testing.expect(reading.count == 42);
+    try std.testing.expect(reading.value == 3.14);
+
+    try std.testing.expectError(error.InvalidNumber, serde.deserialize(&.{ 0x63, 'a', 'b', 'c' }, u32));
+    try std.testing.expectError(error.InvalidNumber, serde.deserialize(&.{ 0x62, '1', 'x' }, f64));
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(&.{ 0x63, '3', '0', '0' }, u8));
+    try std.testing.expect(try serde.deserialize(&.{0x07}, u32) == 7);
+
+    var strict = Serde.init(allocator, .{});
+    defer strict.deinit();
+    try std.testing.expectError(error.TypeMismatch, strict.deserialize(bytes, Reading));
+}
+
+test "c integer types" {
+    if (@bitSizeOf(c_ulong) != 64) return error.SkipZigTest;
+    const allocator = std.testing.allocator;
+    const Ffi = struct { code: c_int, size: c_ulong, flags: c_short, mask: c_uint };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const value = Ffi{ .code = -2147483648, .size = std.math.maxInt(c_ulong), .flags = -3, .mask = 0xffff_ffff };
+    const serialized = try serde.serialize(value);
+    defer allocator.free(serialized);
+    try std.testing.expectEqual(value, try serde.deserialize(serialized, Ffi));
+
+    // {"code": -2147483649}
+    const too_small = &.{ 0xa1, 0x64, 'c', 'o', 'd', 'e', 0x3a, 0x80, 0x00, 0x00, 0x00 };
+    const Code = struct { code: c_int };
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(too_small, Code));
+}
+
+test "string_as_bytes writes string literals as byte strings" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{
+        .encode = .{ .string_as_bytes = true },
+        .decode = .{ .bytes_as_text = true },
+    });
+    defer serde.deinit();
+
+    const serialized = try serde.serialize("on");
+    defer allocator.free(serialized);
+    try std.testing.expect(serialized[0] >> 5 == 2);
+    try std.testing.expectEqualSlices(u8, &.{ 0x42, 'o', 'n' }, serialized);
+
+    const Mode = enum { on, off };
+    try std.testing.expect(try serde.deserialize(serialized, Mode) == .on);
+
+    var strict = Serde.init(allocator, .{});
+    defer strict.deinit();
+    try std.testing.expectError(error.TypeMismatch, strict.deserialize(serialized, Mode));
+}
+
+test "build and encode a DataItem tree" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    var inner = Builder.map(a);
+    _ = inner.put("ok", .{ .bool = true });
+    var list = Builder.array(a);
+    _ = list.append(Builder.int(-1)).appendMap(&inner);
+
+    var root = Builder.map(a);
+    const item = try root
+        .put("a", Builder.int(1))
+        .putArray("b", &.{ Builder.text("x"), .null })
+        .put("c", try list.build())
+        .build();
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(item);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa3,
+        0x61, 'a', 0x01,
+        0x61, 'b', 0x82, 0x61, 'x', 0xf6,
+        0x61, 'c', 0x82, 0x20, 0xa1, 0x62, 'o', 'k', 0xf5,
+    }, serialized);
+
+    var failing = Builder.map(std.testing.failing_allocator);
+    try std.testing.expectError(error.OutOfMemory, failing.put("a", .null).put("b", .null).build());
+}
+
+test "canonical validation rejects long-form simple values" {
+    // Two-byte simple values below 32 are malformed in every mode.
+    try std.testing.expectError(error.InvalidAdditionalInfo, validateCanonical(&.{ 0xf8, 0x00 }));
+    try std.testing.expectError(error.InvalidAdditionalInfo, validateCanonical(&.{ 0xf8, 0x14 }));
+    try std.testing.expectError(error.InvalidAdditionalInfo, validate(&.{ 0xf8, 0x00 }));
+    try validateCanonical(&.{0xe0});
+    try validateCanonical(&.{ 0xf8, 0x20 });
+
+    const strict = CanonicalProfile{ .allow_simple_values = false };
+    try std.testing.expectError(error.SimpleValueForbidden, validateCanonicalProfile(&.{0xe0}, strict));
+    try std.testing.expectError(error.SimpleValueForbidden, validateCanonicalProfile(&.{ 0xf8, 0x20 }, strict));
+    try validateCanonicalProfile(&.{ 0x82, 0xf5, 0xf6 }, strict);
+}
+
+test "serde std.Uri as tag 32 text or a component map" {
+    const allocator = std.testing.allocator;
+    const text = "https://user@example.com:8443/a/b?q=1&r=2#frag";
+    const uri = try std.Uri.parse(text);
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const tagged = try serde.serialize(uri);
+    defer allocator.free(tagged);
+    try std.testing.expectEqualSlices(u8, &.{ 0xd8, 0x20, 0x78, text.len }, tagged[0..4]);
+    try std.testing.expectEqualStrings(text, tagged[4..]);
+
+    var components = Serde.init(allocator, .{ .encode = .{ .uri_format = .components } });
+    defer components.deinit();
+    const map = try components.serialize(uri);
+    defer allocator.free(map);
+    try std.testing.expect(map[0] == 0xa7);
+
+    for ([_][]const u8{ tagged, map }) |bytes| {
+        const decoded = try serde.deserialize(bytes, std.Uri);
+        try std.testing.expectEqualStrings("https", decoded.scheme);
+        try std.testing.expectEqualStrings("user", decoded.user.?.percent_encoded);
+        try std.testing.expectEqualStrings("example.com", decoded.host.?.percent_encoded);
+        try std.testing.expect(decoded.port.? == 8443);
+        try std.testing.expectEqualStrings("/a/b", decoded.path.percent_encoded);
+        try std.testing.expectEqualStrings("q=1&r=2", decoded.query.?.percent_encoded);
+        try std.testing.expectEqualStrings("frag", decoded.fragment.?.percent_encoded);
+        try std.testing.expect(decoded.password == null);
+    }
+
+    // 32("not a uri")
+    const bad = &.{ 0xd8, 0x20, 0x69, 'n', 'o', 't', ' ', 'a', ' ', 'u', 'r', 'i' };
+    try std.testing.expectError(error.InvalidUri, serde.deserialize(bad, std.Uri));
+}
+
+test "decodeInPlace updates only the fields present" {
+    const allocator = std.testing.allocator;
+    const Settings = struct { name: []const u8, port: u16, verbose: bool, retries: u8 };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var settings = Settings{ .name = "svc", .port = 80, .verbose = false, .retries = 3 };
+    const Patch = struct { port: u16, verbose: bool };
+    const patch = try serde.serialize(Patch{ .port = 9000, .verbose = true });
+    defer allocator.free(patch);
+    try serde.decodeInPlace(&settings, patch);
+    try std.testing.expectEqualStrings("svc", settings.name);
+    try std.testing.expect(settings.port == 9000);
+    try std.testing.expect(settings.verbose);
+    try std.testing.expect(settings.retries == 3);
+
+    // {"retries": 5, "port": "x"} fails and leaves every field alone.
+    const bad = &.{ 0xa2, 0x67, 'r', 'e', 't', 'r', 'i', 'e', 's', 0x05, 0x64, 'p', 'o', 'r', 't', 0x61, 'x' };
+    try std.testing.expectError(error.TypeMismatch, serde.decodeInPlace(&settings, bad));
+    try std.testing.expect(settings.retries == 3 and settings.port == 9000);
+}
+
+test "sequence encoder output reads back with the sequence decoder" {
+    const allocator = std.testing.allocator;
+    const Point = struct { x: i32, y: i32 };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var seq = try serde.sequenceEncoder();
+    try seq.write(@as(u8, 1));
+    try seq.write("two");
+    try seq.write(Point{ .x = -3, .y = 4 });
+    try std.testing.expect(seq.count == 3);
+    const bytes = try seq.finish();
+    defer allocator.free(bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0x01, 0x63, 't', 'w', 'o', 0xa2 }, bytes[0..6]);
+
+    var dec = serde.sequenceDecoder(bytes);
+    try std.testing.expect(try serde.deserializeNext(&dec, u8) == 1);
+    try std.testing.expectEqualStrings("two", try serde.deserializeNext(&dec, []const u8));
+    try std.testing.expectEqual(Point{ .x = -3, .y = 4 }, try serde.deserializeNext(&dec, Point));
+    try std.testing.expect(dec.remaining() == 0);
+}
+
+test "union formats for the same union" {
+    const allocator = std.testing.allocator;
+    const Shape = union(enum) { circle: u32, square: u32 };
+    const value = Shape{ .square = 5 };
+    const cases = [_]struct { format: UnionFormat, bytes: []const u8 }{
+        .{ .format = .name_array, .bytes = &.{ 0x82, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x05 } },
+        .{ .format = .int_array, .bytes = &.{ 0x82, 0x01, 0x05 } },
+        .{ .format = .single_key_map, .bytes = &.{ 0xa1, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x05 } },
+    };
+
+    for (cases) |case| {
+        var serde = Serde.init(allocator, .{
+            .encode = .{ .union_format = case.format },
+            .decode = .{ .union_format = case.format },
+        });
+        defer serde.deinit();
+        const serialized = try serde.serialize(value);
+        defer allocator.free(serialized);
+        try std.testing.expectEqualSlices(u8, case.bytes, serialized);
+        try std.testing.expectEqual(value, try serde.deserialize(serialized, Shape));
+    }
+
+    var serde = Serde.init(allocator, .{ .decode = .{ .union_format = .single_key_map } });
+    defer serde.deinit();
+    // {"circle": 1, "square": 2}
+    const two_keys = &.{ 0xa2, 0x66, 'c', 'i', 'r', 'c', 'l', 'e', 0x01, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x02 };
+    try std.testing.expectError(error.InvalidUnionRepresentation, serde.deserialize(two_keys, Shape));
+}
+
+test "indefinite_length applies to unions, error unions and addresses" {
+    const allocator = std.testing.allocator;
+    const Shape = union(enum) { circle: u32, square: u32 };
+    const cases = [_]struct { format: UnionFormat, bytes: []const u8 }{
+        .{ .format = .name_array, .bytes = &.{ 0x9f, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x05, 0xff } },
+        .{ .format = .int_array, .bytes = &.{ 0x9f, 0x01, 0x05, 0xff } },
+        .{ .format = .single_key_map, .bytes = &.{ 0xbf, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x05, 0xff } },
+    };
+    for (cases) |case| {
+        var serde = Serde.init(allocator, .{
+            .encode = .{ .union_format = case.format, .indefinite_length = true },
+            .decode = .{ .union_format = case.format },
+        });
+        defer serde.deinit();
+        const serialized = try serde.serialize(Shape{ .square = 5 });
+        defer allocator.free(serialized);
+        try std.testing.expectEqualSlices(u8, case.bytes, serialized);
+        try std.testing.expectEqual(Shape{ .square = 5 }, try serde.deserialize(serialized, Shape));
+    }
+
+    var serde = Serde.init(allocator, .{ .encode = .{ .indefinite_length = true } });
+    defer serde.deinit();
+
+    const widest = try serde.serialize(Shape{ .square = std.math.maxInt(u32) });
+    defer allocator.free(widest);
+    try std.testing.expect(widest.len == maxEncodedLen(Shape));
+
+    const Error = error{Denied};
+    const ok: Error!u8 = 7;
+    const ok_bytes = try serde.serialize(ok);
+    defer allocator.free(ok_bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0xbf, 0x62, 'o', 'k', 0x07, 0xff }, ok_bytes);
+    try std.testing.expect(try (try serde.deserialize(ok_bytes, Error!u8)) == 7);
+
+    const address = std.net.Address.initIp4(.{ 127, 0, 0, 1 }, 80);
+    const address_bytes = try serde.serialize(address);
+    defer allocator.free(address_bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0x9f, 0x44, 127, 0, 0, 1, 0x18, 0x50, 0xff }, address_bytes);
+    try std.testing.expect((try serde.deserialize(address_bytes, std.net.Address)).eql(address));
+
+    // A second payload before the break is rejected.
+    const extra = &.{ 0x9f, 0x66, 's', 'q', 'u', 'a', 'r', 'e', 0x05, 0x06, 0xff };
+    try std.testing.expectError(error.InvalidUnionRepresentation, serde.deserialize(extra, Shape));
+}
+
+test "lengths beyond usize are rejected, not truncated" {
+    const allocator = std.testing.allocator;
+    try std.testing.expectError(error.LengthExceedsPlatform, lengthAs(u32, 1 << 40));
+    try std.testing.expect(try lengthAs(u32, 1 << 31) == 1 << 31);
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    // A text string header declaring 2^40 bytes. On 64-bit targets the length
+    // fits and the allocation limit catches it instead.
+    const bytes = &.{ 0x7b, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00 };
+    const expected = if (@bitSizeOf(usize) < 64) error.LengthExceedsPlatform else error.AllocationTooLarge;
+    try std.testing.expectError(expected, serde.deserialize(bytes, []const u8));
+}
+
+test "DataItem maps round trip mixed key types" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // {1: "one", "two": 2}
+    const bytes = &.{ 0xa2, 0x01, 0x63, 'o', 'n', 'e', 0x63, 't', 'w', 'o', 0x02 };
+    const item = try serde.deserialize(bytes, DataItem);
+    try std.testing.expect(item.map.len == 2);
+    try std.testing.expect(item.map[0].key.uint == 1);
+    try std.testing.expectEqualStrings("one", item.map[0].value.text);
+    try std.testing.expectEqualStrings("two", item.map[1].key.text);
+    try std.testing.expect(item.map[1].value.uint == 2);
+
+    const serialized = try serde.serialize(item);
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, bytes, serialized);
+}
+
+test "diff and apply map and array patches" {
+    const allocator = std.testing.allocator;
+    // {"a": 1, "b": 2, "c": 3} -> {"a": 1, "b": 20, "d": 4}
+    const before = &.{ 0xa3, 0x61, 'a', 0x01, 0x61, 'b', 0x02, 0x61, 'c', 0x03 };
+    const after = &.{ 0xa3, 0x61, 'a', 0x01, 0x61, 'b', 0x14, 0x61, 'd', 0x04 };
+    const patch = try diff(allocator, before, after);
+    defer patch.deinit();
+
+    const changes = patch.value.changes;
+    try std.testing.expect(changes.len == 3);
+    try std.testing.expect(changes[0].op == .change);
+    try std.testing.expectEqualStrings("b", changes[0].key.text);
+    try std.testing.expect(changes[0].value.uint == 20);
+    try std.testing.expect(changes[1].op == .add);
+    try std.testing.expectEqualStrings("d", changes[1].key.text);
+    try std.testing.expect(changes[2].op == .remove);
+    try std.testing.expectEqualStrings("c", changes[2].key.text);
+
+    const patched = try apply(allocator, before, patch.value);
+    defer allocator.free(patched);
+    try std.testing.expectEqualSlices(u8, after, patched);
+
+    // [1, 2, 3] -> [1, 5]
+    const shorter = try diff(allocator, &.{ 0x83, 0x01, 0x02, 0x03 }, &.{ 0x82, 0x01, 0x05 });
+    defer shorter.deinit();
+    try std.testing.expect(shorter.value.changes.len == 2);
+    const trimmed = try apply(allocator, &.{ 0x83, 0x01, 0x02, 0x03 }, shorter.value);
+    defer allocator.free(trimmed);
+    try std.testing.expectEqualSlices(u8, &.{ 0x82, 0x01, 0x05 }, trimmed);
+
+    try std.testing.expectError(error.TypeMismatch, diff(allocator, &.{0xa0}, &.{0x80}));
+    try std.testing.expectError(error.PatchMismatch, apply(allocator, &.{0xa0}, patch.value));
+}
+
+test "error unions with a void payload" {
+    const allocator = std.testing.allocator;
+    const Error = error{ NotFound, Denied };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const ok: Error!void = {};
+    const ok_bytes = try serde.serialize(ok);
+    defer allocator.free(ok_bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x62, 'o', 'k', 0xf6 }, ok_bytes);
+    try (try serde.deserialize(ok_bytes, Error!void));
+
+    const failed: Error!void = error.Denied;
+    const err_bytes = try serde.serialize(failed);
+    defer allocator.free(err_bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x63, 'e', 'r', 'r', 0x66, 'D', 'e', 'n', 'i', 'e', 'd' }, err_bytes);
+    try std.testing.expectError(error.Denied, try serde.deserialize(err_bytes, Error!void));
+
+    // {"err": "Missing"} names no member of the set.
+    const unknown = &.{ 0xa1, 0x63, 'e', 'r', 'r', 0x67, 'M', 'i', 's', 's', 'i', 'n', 'g' };
+    try std.testing.expectError(error.InvalidEnumTag, serde.deserialize(unknown, Error!void));
+}
+
+test "maxEncodedLen bounds worst-case encodings" {
+    const allocator = std.testing.allocator;
+    try std.testing.expect(maxEncodedLen(u8) == 2);
+    try std.testing.expect(maxEncodedLen(i32) == 5);
+    try std.testing.expect(maxEncodedLen(u64) == 9);
+    try std.testing.expect(maxEncodedLen(?u16) == 3);
+    try std.testing.expect(maxEncodedLen(f64) == 9);
+
+    const Kind = enum { a, long_name };
+    const Record = struct { id: u32, flag: bool, kind: Kind, samples: [3]u16 };
+    const worst = Record{
+        .id = std.math.maxInt(u32),
+        .flag = true,
+        .kind = .long_name,
+        .samples = [_]u16{std.math.maxInt(u16)} ** 3,
+    };
+    try std.testing.expect(maxEncodedLen(Record) == 50);
+
+    var definite = Serde.init(allocator, .{});
+    defer definite.deinit();
+    const short = try definite.serialize(worst);
+    defer allocator.free(short);
+    try std.testing.expect(short.len <= maxEncodedLen(Record));
+
+    // Indefinite-length containers are the worst case.
+    var indefinite = Serde.init(allocator, .{ .encode = .{ .indefinite_length = true } });
+    defer indefinite.deinit();
+    const long = try indefinite.serialize(worst);
+    defer allocator.free(long);
+    try std.testing.expect(long.len == maxEncodedLen(Record));
+
+    const extreme = ExtendedTime{ .seconds = std.math.minInt(i64), .nanos = 999_999_999 };
+    try std.testing.expect(maxEncodedLen(ExtendedTime) == 21);
+    const time = try indefinite.serialize(extreme);
+    defer allocator.free(time);
+    try std.testing.expect(time.len == maxEncodedLen(ExtendedTime));
+}
+
+test "decodeWithAllocators keeps strings apart from containers" {
+    const allocator = std.testing.allocator;
+    const CountingAllocator = @import("testing.zig").CountingAllocator;
+    var strings_arena = std.heap.ArenaAllocator.init(allocator);
+    defer strings_arena.deinit();
+    var containers_arena = std.heap.ArenaAllocator.init(allocator);
+    defer containers_arena.deinit();
+    var strings = CountingAllocator.init(strings_arena.allocator());
+    var containers = CountingAllocator.init(containers_arena.allocator());
+
+    // ["ab", "cde"]
+    const bytes = &.{ 0x82, 0x62, 'a', 'b', 0x63, 'c', 'd', 'e' };
+    const names = try decodeWithAllocators(
+        .{ .strings = strings.allocator(), .containers = containers.allocator() },
+        [][]const u8,
+        bytes,
+        .{},
+    );
+    try std.testing.expectEqualStrings("ab", names[0]);
+    try std.testing.expectEqualStrings("cde", names[1]);
+    try std.testing.expect(strings.allocations == 2 and strings.bytes == 5);
+    try std.testing.expect(containers.allocations == 1 and containers.bytes == 2 * @sizeOf([]const u8));
+}
+
+test "bounded arrays receive strings without allocating" {
+    const allocator = std.testing.allocator;
+    const Name = std.BoundedArray(u8, 8);
+
+    var no_alloc = Serde.init(std.testing.failing_allocator, .{});
+    defer no_alloc.deinit();
+    const fits = try no_alloc.deserialize(&.{ 0x66, 's', 'e', 'n', 's', 'o', 'r' }, Name);
+    try std.testing.expectEqualStrings("sensor", fits.constSlice());
+    const too_long = &.{ 0x6b, 't', 'e', 'm', 'p', 'e', 'r', 'a', 't', 'u', 'r', 'e' };
+    try std.testing.expectError(error.CapacityExceeded, no_alloc.deserialize(too_long, Name));
+
+    // (_ "sen", "sor") is joined in place.
+    const chunked = &.{ 0x7f, 0x63, 's', 'e', 'n', 0x63, 's', 'o', 'r', 0xff };
+    try std.testing.expectEqualStrings("sensor", (try no_alloc.deserialize(chunked, Name)).constSlice());
+    // (_ h'0102030405', h'06070809') overflows on the second chunk.
+    const chunked_long = &.{ 0x5f, 0x45, 1, 2, 3, 4, 5, 0x44, 6, 7, 8, 9, 0xff };
+    try std.testing.expectError(error.CapacityExceeded, no_alloc.deserialize(chunked_long, Name));
+    var limited = Serde.init(std.testing.failing_allocator, .{ .decode = .{ .max_string_chunks = 1 } });
+    defer limited.deinit();
+    try std.testing.expectError(error.TooManyStringChunks, limited.deserialize(chunked, Name));
+
+    const Label = struct { name: Name, codes: std.BoundedArray(u16, 2) };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const label = Label{ .name = try Name.fromSlice("probe"), .codes = try std.BoundedArray(u16, 2).fromSlice(&.{ 7, 300 }) };
+    const serialized = try serde.serialize(label);
+    defer allocator.free(serialized);
+    const decoded = try serde.deserialize(serialized, Label);
+    try std.testing.expectEqualStrings("probe", decoded.name.constSlice());
+    try std.testing.expectEqualSlices(u16, &.{ 7, 300 }, decoded.codes.constSlice());
+
+    try std.testing.expectError(error.CapacityExceeded, serde.deserialize(&.{ 0x83, 0x01, 0x02, 0x03 }, std.BoundedArray(u16, 2)));
+}
+
+test "null_slice keeps or collapses null and empty slices" {
+    const allocator = std.testing.allocator;
+    const missing: ?[]const u32 = null;
+    const empty: ?[]const u32 = &.{};
+
+    var keep = Serde.init(allocator, .{});
+    defer keep.deinit();
+    const kept_null = try keep.serialize(missing);
+    defer allocator.free(kept_null);
+    try std.testing.expectEqualSlices(u8, &.{0xf6}, kept_null);
+    const kept_empty = try keep.serialize(empty);
+    defer allocator.free(kept_empty);
+    try std.testing.expectEqualSlices(u8, &.{0x80}, kept_empty);
+    try std.testing.expect(try keep.deserialize(kept_null, ?[]const u32) == null);
+    try std.testing.expect((try keep.deserialize(kept_empty, ?[]const u32)).?.len == 0);
+
+    var collapse = Serde.init(allocator, .{ .encode = .{ .null_slice = .empty_array } });
+    defer collapse.deinit();
+    const collapsed_null = try collapse.serialize(missing);
+    defer allocator.free(collapsed_null);
+    try std.testing.expectEqualSlices(u8, &.{0x80}, collapsed_null);
+    const collapsed_empty = try collapse.serialize(empty);
+    defer allocator.free(collapsed_empty);
+    try std.testing.expectEqualSlices(u8, &.{0x80}, collapsed_empty);
+
+    const no_bytes = try collapse.serialize(@as(?[]const u8, null));
+    defer allocator.free(no_bytes);
+    try std.testing.expectEqualSlices(u8, &.{0x40}, no_bytes);
+}
+
+test "deterministic floats use the shortest of f16, f32 and f64" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer serde.deinit();
+
+    const cases = [_]struct { value: f64, bytes: []const u8 }{
+        .{ .value = 1.5, .bytes = &.{ 0xf9, 0x3e, 0x00 } },
+        .{ .value = 100000.5, .bytes = &.{ 0xfa, 0x47, 0xc3, 0x50, 0x40 } },
+        .{ .value = 0.1, .bytes = &.{ 0xfb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a } },
+        .{ .value = std.math.nan(f64), .bytes = &.{ 0xf9, 0x7e, 0x00 } },
+    };
+    for (cases) |case| {
+        const serialized = try serde.serialize(case.value);
+        defer allocator.free(serialized);
+        try std.testing.expectEqualSlices(u8, case.bytes, serialized);
+    }
+
+    const single = try serde.serialize(@as(f32, 1.5));
+    defer allocator.free(single);
+    try std.testing.expectEqualSlices(u8, &.{ 0xf9, 0x3e, 0x00 }, single);
+
+    try std.testing.expectError(error.NonCanonicalFloat, validateCanonical(&.{ 0xfa, 0x3f, 0xc0, 0x00, 0x00 }));
+    try validateCanonical(&.{ 0xf9, 0x3e, 0x00 });
+}
+
+test "slices of DataItem encode as arrays" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const inner = [_]DataItem.Pair{.{ .key = .{ .text = "k" }, .value = .{ .bool = true } }};
+    const items = [_]DataItem{ .{ .uint = 7 }, .{ .text = "hi" }, .{ .map = &inner } };
+    const Envelope = struct { id: u8, body: []const DataItem };
+    const serialized = try serde.serialize(Envelope{ .id = 1, .body = &items });
+    defer allocator.free(serialized);
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa2,
+        0x62, 'i', 'd', 0x01,
+        0x64, 'b', 'o', 'd', 'y', 0x83, 0x07, 0x62, 'h', 'i', 0xa1, 0x61, 'k', 0xf5,
+    }, serialized);
+}
+
+test "a break inside a definite-length container is rejected" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // [1, <break>]
+    const array = &.{ 0x82, 0x01, 0xff };
+    try std.testing.expectError(error.UnexpectedBreak, validate(array));
+    try std.testing.expectError(error.UnexpectedBreak, serde.deserialize(array, DataItem));
+    var dec = serde.sequenceDecoder(array);
+    try std.testing.expectError(error.UnexpectedBreak, serde.deserializeNext(&dec, []u32));
+    try std.testing.expect(dec.offset() == 2);
+
+    // {"a": <break>} and {<break>: 1}
+    const value = &.{ 0xa1, 0x61, 'a', 0xff };
+    const key = &.{ 0xa1, 0xff, 0x01 };
+    const Entry = struct { a: u8 };
+    try std.testing.expectError(error.UnexpectedBreak, validate(value));
+    try std.testing.expectError(error.UnexpectedBreak, serde.deserialize(value, Entry));
+    try std.testing.expectError(error.UnexpectedBreak, serde.deserialize(key, Entry));
+    dec = serde.sequenceDecoder(value);
+    try std.testing.expectError(error.UnexpectedBreak, serde.deserializeNext(&dec, DataItem));
+    try std.testing.expect(dec.offset() == 3);
+}
+
+test "unmanaged array lists and string hash maps round trip" {
+    const allocator = std.testing.allocator;
+    const Inventory = struct {
+        ids: std.ArrayListUnmanaged(u32),
+        stock: std.StringArrayHashMapUnmanaged(u16),
+    };
+
+    var inventory = Inventory{ .ids = .empty, .stock = .empty };
+    defer inventory.ids.deinit(allocator);
+    defer inventory.stock.deinit(allocator);
+    try inventory.ids.appendSlice(allocator, &.{ 3, 1, 2 });
+    try inventory.stock.put(allocator, "bolt", 40);
+    try inventory.stock.put(allocator, "nut", 7);
+
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+    const serialized = try serde.serialize(inventory);
+    defer allocator.free(serialized);
+
+    const decoded = try serde.deserialize(serialized, Inventory);
+    try std.testing.expectEqualSlices(u32, &.{ 3, 1, 2 }, decoded.ids.items);
+    try std.testing.expect(decoded.stock.count() == 2);
+    try std.testing.expectEqualStrings("bolt", decoded.stock.keys()[0]);
+    try std.testing.expect(decoded.stock.get("bolt").? == 40);
+    try std.testing.expect(decoded.stock.get("nut").? == 7);
+}
+
+test "validateAgainst reports schema violations" {
+    const allocator = std.testing.allocator;
+    const Person = struct {
+        name: []const u8,
+        age: u8,
+        email: ?[]const u8 = null,
+
+        pub const cbor_ranges = .{ .age = .{ 0, 150 } };
+    };
+    const schema = comptime Schema.of(Person);
+
+    // {"age": "old"}
+    const wrong = try validateAgainst(allocator, schema, &.{ 0xa1, 0x63, 'a', 'g', 'e', 0x63, 'o', 'l', 'd' });
+    defer wrong.deinit();
+    try std.testing.expect(wrong.value.len == 2);
+    try std.testing.expectEqualStrings("name", wrong.value[0].path);
+    try std.testing.expect(wrong.value[0].kind == .missing_field);
+    try std.testing.expectEqualStrings("age", wrong.value[1].path);
+    try std.testing.expect(wrong.value[1].kind == .type_mismatch);
+
+    // {"name": "x", "age": 200, "email": null}
+    const bytes = &.{ 0xa3, 0x64, 'n', 'a', 'm', 'e', 0x61, 'x', 0x63, 'a', 'g', 'e', 0x18, 0xc8, 0x65, 'e', 'm', 'a', 'i', 'l', 0xf6 };
+    const old = try validateAgainst(allocator, schema, bytes);
+    defer old.deinit();
+    try std.testing.expect(old.value.len == 1);
+    try std.testing.expect(old.value[0].kind == .out_of_range);
+
+    const fine = try validateAgainst(allocator, schema, &.{ 0xa2, 0x64, 'n', 'a', 'm', 'e', 0x61, 'x', 0x63, 'a', 'g', 'e', 0x18, 0x20 });
+    defer fine.deinit();
+    try std.testing.expect(fine.value.len == 0);
+}
+
+test "u256 round-trips through tagged bignums" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const big: u256 = (1 << 255) + 12345;
+    const encoded = try serde.serialize(big);
+    defer allocator.free(encoded);
+    // 2(h'80...3039'): the full 32 bytes are needed.
+    try std.testing.expectEqualSlices(u8, &.{ 0xc2, 0x58, 0x20, 0x80 }, encoded[0..4]);
+    try std.testing.expect(encoded.len == 35);
+    try std.testing.expect(try serde.deserialize(encoded, u256) == big);
+
+    const negative: i256 = -(1 << 254) - 7;
+    const neg_encoded = try serde.serialize(negative);
+    defer allocator.free(neg_encoded);
+    try std.testing.expect(neg_encoded[0] == 0xc3);
+    try std.testing.expect(try serde.deserialize(neg_encoded, i256) == negative);
+
+    // Values that fit in 64 bits stay plain integers.
+    const small = try serde.serialize(@as(i256, -100));
+    defer allocator.free(small);
+    try std.testing.expectEqualSlices(u8, &.{ 0x38, 0x63 }, small);
+    // 2^64 takes 9 magnitude bytes.
+    const two_64 = try serde.serialize(@as(u256, 1 << 64));
+    defer allocator.free(two_64);
+    try std.testing.expectEqualSlices(u8, &([_]u8{ 0xc2, 0x49, 0x01 } ++ [_]u8{0} ** 8), two_64);
+    try std.testing.expectError(error.IntegerOutOfRange, serde.deserialize(encoded, u128));
+}
+
+test "encodeTagged wraps the top-level item" {
     const allocator = std.testing.allocator;
-    const MyRequest = struct {
-        id: u64,
-        name: []const u8,
-    };
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
-    const cbor_bytes = &.{ 0xa1, 0x62, 0x69, 0x64, 0x18, 0x7b };
 
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
+    const Point = struct { x: u8, y: u8 };
+    const encoded = try serde.encodeTagged(1000, Point{ .x = 1, .y = 2 });
+    defer allocator.free(encoded);
+    try std.testing.expectEqualSlices(u8, &.{ 0xd9, 0x03, 0xe8, 0xa2 }, encoded[0..4]);
 
-    const result = serde.deserialize(cbor_bytes, MyRequest);
-    try std.testing.expectError(error.MissingRequiredField, result);
+    const item = try serde.deserialize(encoded, DataItem);
+    try std.testing.expect(item == .tag);
+    try std.testing.expect(item.tag.number == 1000);
+    try std.testing.expect(item.tag.content.* == .map);
+    try std.testing.expect(item.tag.content.map.len == 2);
 }
 
-test "serialize and deserialize struct with optional field" {
+test "EnumMap round-trips with absent keys" {
     const allocator = std.testing.allocator;
-    const MyStruct = struct {
-        id: u64,
-        name: []const u8,
-        description: ?[]const u8 = null,
-    };
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
 
-    const original = MyStruct{
-        .id = 42,
-        .name = "Test",
-        .description = null,
-    };
+    const Color = enum { red, green, blue };
+    var weights = std.enums.EnumMap(Color, u16){};
+    weights.put(.red, 3);
+    weights.put(.blue, 500);
 
-    const serialized = try serde.serialize(original);
-    defer allocator.free(serialized);
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
+    const encoded = try serde.serialize(weights);
+    defer allocator.free(encoded);
+    try std.testing.expect(encoded[0] == 0xa2);
 
-    const deserialized = try serde.deserialize(serialized, MyStruct);
+    const decoded = try serde.deserialize(encoded, std.enums.EnumMap(Color, u16));
+    try std.testing.expect(decoded.count() == 2);
+    try std.testing.expect(decoded.get(.red).? == 3);
+    try std.testing.expect(decoded.get(.blue).? == 500);
+    try std.testing.expect(!decoded.contains(.green));
 
-    try std.testing.expect(deserialized.id == original.id);
-    try std.testing.expect(std.mem.eql(u8, deserialized.name, original.name));
-    try std.testing.expect(deserialized.description == null);
+    // Integer keys are accepted too: {1: 7}
+    const by_int = try serde.deserialize(&.{ 0xa1, 0x01, 0x07 }, std.enums.EnumMap(Color, u16));
+    try std.testing.expect(by_int.get(.green).? == 7);
 }
 
-test "extract field from serialized data" {
+test "copyEncoded extracts the first item of a sequence" {
+    const allocator = std.testing.allocator;
+    // [1, "a"], {"b": 2}, 3
+    const sequence = [_]u8{ 0x82, 0x01, 0x61, 'a', 0xa1, 0x61, 'b', 0x02, 0x03 };
+    const first = try copyEncoded(allocator, &sequence);
+    defer allocator.free(first.bytes);
+    try std.testing.expectEqualSlices(u8, &.{ 0x82, 0x01, 0x61, 'a' }, first.bytes);
+    try std.testing.expect(first.consumed == 4);
+
+    const second = try copyEncoded(allocator, sequence[first.consumed..]);
+    defer allocator.free(second.bytes);
+    try std.testing.expect(second.consumed == 4);
+
+    try std.testing.expectError(error.EndOfStream, copyEncoded(allocator, &.{ 0x82, 0x01 }));
+}
+
+test "DataItem maps with boolean and null keys" {
     const allocator = std.testing.allocator;
-    const MyStruct = struct {
-        id: u64,
-        name: []const u8,
-        city: []const u8,
-    };
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
 
-    const original = MyStruct{
-        .id = 42,
-        .name = "Test",
-        .city = "Pune",
-    };
+    // {true: 1, false: "no", null: []}
+    const bytes = [_]u8{ 0xa3, 0xf5, 0x01, 0xf4, 0x62, 'n', 'o', 0xf6, 0x80 };
+    const item = try serde.deserialize(&bytes, DataItem);
+    try std.testing.expect(item.map.len == 3);
+    try std.testing.expect(item.map[0].key.bool == true);
+    try std.testing.expect(item.map[1].key.bool == false);
+    try std.testing.expect(item.map[2].key == .null);
 
-    const serialized = try serde.serialize(original);
-    defer allocator.free(serialized);
+    const encoded = try serde.serialize(item);
+    defer allocator.free(encoded);
+    try std.testing.expectEqualSlices(u8, &bytes, encoded);
 
-    const extracted_id = try serde.extractField(serialized, "id", u64);
-    try std.testing.expect(extracted_id == 42);
+    const diagnostic = try toDiagnostic(allocator, &bytes);
+    defer allocator.free(diagnostic);
+    try std.testing.expectEqualStrings("{true: 1, false: \"no\", null: []}", diagnostic);
+}
 
-    const extracted_name = try serde.extractField(serialized, "name", []const u8);
-    if (extracted_name) |name| {
-        std.debug.print("Extracted name: {s}\n", .{name});
-        try std.testing.expect(std.mem.eql(u8, name, "Test"));
-    } else {
-        std.debug.print("Extracted name not found\n", .{});
-        try std.testing.expect(false);
-    }
+test "float_as_decimal_string renders floats into string fields" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .decode = .{ .float_as_decimal_string = true } });
+    defer serde.deinit();
 
-    const extracted_city = try serde.extractField(serialized, "city", []const u8);
-    if (extracted_city) |city| {
-        std.debug.print("Extracted city: {s}\n", .{city});
-        try std.testing.expect(std.mem.eql(u8, city, "Pune"));
-    } else {
-        std.debug.print("Extracted name not found\n", .{});
-        try std.testing.expect(false);
-    }
+    const Price = struct { amount: []const u8 };
+    // {"amount": 0.1} as a double
+    const double = [_]u8{ 0xa1, 0x66, 'a', 'm', 'o', 'u', 'n', 't', 0xfb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a };
+    try std.testing.expectEqualStrings("0.1", (try serde.deserialize(&double, Price)).amount);
+    // The same value as a single-precision float keeps its short form.
+    const single = [_]u8{ 0xa1, 0x66, 'a', 'm', 'o', 'u', 'n', 't', 0xfa, 0x3d, 0xcc, 0xcc, 0xcd };
+    try std.testing.expectEqualStrings("0.1", (try serde.deserialize(&single, Price)).amount);
+    // Strings are still read as-is.
+    const text = [_]u8{ 0xa1, 0x66, 'a', 'm', 'o', 'u', 'n', 't', 0x63, '1', '.', '5' };
+    try std.testing.expectEqualStrings("1.5", (try serde.deserialize(&text, Price)).amount);
 }
 
-test "serde person struct with array of address structs" {
+test "struct_order alphabetical sorts struct keys by name" {
     const allocator = std.testing.allocator;
-    const Address = struct {
-        street: []const u8,
-        city: []const u8,
-    };
-    const Person = struct {
-        name: []const u8,
-        age: u32,
-        addresses: []Address,
-    };
+    const Record = struct { zeta: u8, alpha: u8, mid: u8 };
+    const record = Record{ .zeta = 1, .alpha = 2, .mid = 3 };
+
+    var serde = Serde.init(allocator, .{ .encode = .{ .struct_order = .alphabetical } });
+    defer serde.deinit();
+    const encoded = try serde.serialize(record);
+    defer allocator.free(encoded);
+    try std.testing.expectEqualSlices(u8, &.{
+        0xa3,
+        0x65, 'a', 'l', 'p', 'h', 'a', 0x02,
+        0x63, 'm', 'i', 'd', 0x03,
+        0x64, 'z', 'e', 't', 'a', 0x01,
+    }, encoded);
+
+    // Deterministic order (shorter keys first here) wins.
+    var canonical = Serde.init(allocator, .{ .encode = .{ .struct_order = .alphabetical, .deterministic = true } });
+    defer canonical.deinit();
+    const sorted = try canonical.serialize(record);
+    defer allocator.free(sorted);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa3, 0x63, 'm', 'i', 'd', 0x03 }, sorted[0..6]);
+}
 
+test "errorCategory separates malformed, invalid and unsupported input" {
+    const allocator = std.testing.allocator;
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
 
-    const person = Person{
-        .name = "Alice",
-        .age = 30,
-        .addresses = try allocator.dupe(Address, &[_]Address{
-            Address{ .street = "123 Main St", .city = "Wonderland" },
-            Address{ .street = "456 Elm St", .city = "Dreamland" },
-        }),
-    };
+    const category = struct {
+        fn of(result: anytype) !ErrorCategory {
+            _ = result catch |err| return errorCategory(err);
+            return error.TestExpectedError;
+        }
+    }.of;
 
-    defer allocator.free(person.addresses);
+    // Truncated array.
+    try std.testing.expect(try category(serde.deserialize(&.{ 0x82, 0x01 }, DataItem)) == .malformed);
+    // Text string with an invalid UTF-8 byte.
+    try std.testing.expect(try category(serde.deserialize(&.{ 0x61, 0xff }, DataItem)) == .invalid);
+    // Well-formed, but not an integer.
+    try std.testing.expect(try category(serde.deserialize(&.{ 0x61, 'a' }, u8)) == .unsupported);
 
-    const serialized = try serde.serialize(person);
-    defer allocator.free(serialized);
+    try std.testing.expect(errorCategory(error.DuplicateKey) == .invalid);
+    try std.testing.expect(errorCategory(error.NestingDepthExceeded) == .resource);
+}
 
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
+test "bit_set_as_int writes small bit sets as integer masks" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .encode = .{ .bit_set_as_int = true } });
+    defer serde.deinit();
 
-    const deserialized_person = try serde.deserialize(serialized, Person);
+    var flags = std.StaticBitSet(40).initEmpty();
+    flags.set(0);
+    flags.set(3);
+    flags.set(39);
+    const encoded = try serde.serialize(flags);
+    defer allocator.free(encoded);
+    // 0x80_0000_0009 needs a 64-bit argument.
+    try std.testing.expectEqualSlices(u8, &.{ 0x1b, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x09 }, encoded);
 
-    try std.testing.expect(std.mem.eql(u8, deserialized_person.name, person.name));
-    try std.testing.expect(deserialized_person.age == person.age);
-    try std.testing.expect(deserialized_person.addresses.len == person.addresses.len);
+    const decoded = try serde.deserialize(encoded, std.StaticBitSet(40));
+    try std.testing.expect(decoded.eql(flags));
 
-    for (0..deserialized_person.addresses.len) |i| {
-        try std.testing.expect(std.mem.eql(u8, deserialized_person.addresses[i].street, person.addresses[i].street));
-        try std.testing.expect(std.mem.eql(u8, deserialized_person.addresses[i].city, person.addresses[i].city));
-    }
+    // Bits past the end of the set are rejected.
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x18, 0x10 }, std.StaticBitSet(4)));
 }
 
-test "serde struct with all sorts of types" {
+test "decodeTag splits off the outer tag" {
+    // 32(h'0102')
+    const tagged = try decodeTag(&.{ 0xd8, 0x20, 0x42, 0x01, 0x02 });
+    try std.testing.expect(tagged.tag == 32);
+    try std.testing.expectEqualSlices(u8, &.{ 0x42, 0x01, 0x02 }, tagged.content);
+
+    // Nested tags only lose the outer one: 1000(1(0))
+    const nested = try decodeTag(&.{ 0xd9, 0x03, 0xe8, 0xc1, 0x00 });
+    try std.testing.expect(nested.tag == 1000);
+    try std.testing.expectEqualSlices(u8, &.{ 0xc1, 0x00 }, nested.content);
+
+    try std.testing.expectError(error.TypeMismatch, decodeTag(&.{ 0x42, 0x01, 0x02 }));
+}
+
+test "untagged unions take the first variant that decodes" {
     const allocator = std.testing.allocator;
-    const MyStruct = struct {
-        id: u64,
-        age: i64,
-        score: f32,
-        name: []const u8,
-        active: bool,
-        tags: [][]const u8,
-    };
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
 
-    var tags_array = [_][]const u8{ "tag1", "tag2", "tag3" };
+    const Value = union(enum) {
+        int: i64,
+        text: []const u8,
 
-    const original = MyStruct{
-        .id = 42,
-        .age = 30,
-        .score = 85.5,
-        .name = "Test",
-        .active = true,
-        .tags = &tags_array,
+        pub const cbor_union_format = .untagged;
     };
 
-    const serialized = try serde.serialize(original);
-    defer allocator.free(serialized);
+    const int_bytes = try serde.serialize(Value{ .int = -5 });
+    defer allocator.free(int_bytes);
+    try std.testing.expectEqualSlices(u8, &.{0x24}, int_bytes);
+    try std.testing.expect((try serde.deserialize(int_bytes, Value)).int == -5);
 
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
+    const text = try serde.deserialize(&.{ 0x62, 'h', 'i' }, Value);
+    try std.testing.expectEqualStrings("hi", text.text);
 
-    const deserialized = try serde.deserialize(serialized, MyStruct);
+    try std.testing.expectError(error.NoMatchingVariant, serde.deserialize(&.{0xf5}, Value));
+}
 
-    try std.testing.expect(deserialized.id == original.id);
-    try std.testing.expect(std.mem.eql(u8, deserialized.name, original.name));
-    try std.testing.expect(deserialized.active == original.active);
-    try std.testing.expect(deserialized.tags.len == original.tags.len);
-    try std.testing.expect(deserialized.age == original.age);
-    try std.testing.expect(deserialized.score == original.score);
-    for (0..deserialized.tags.len) |i| {
-        try std.testing.expect(std.mem.eql(u8, deserialized.tags[i], original.tags[i]));
-    }
+test "compareCanonical ignores encoding differences" {
+    const allocator = std.testing.allocator;
+    const eq = std.math.Order.eq;
+
+    // 5 with a one-byte argument.
+    try std.testing.expect(try compareCanonical(allocator, &.{0x05}, &.{ 0x18, 0x05 }) == eq);
+    // {"b": 1, "a": 2} and {_ "a": 2, "b": 1}
+    try std.testing.expect(try compareCanonical(
+        allocator,
+        &.{ 0xa2, 0x61, 'b', 0x01, 0x61, 'a', 0x02 },
+        &.{ 0xbf, 0x61, 'a', 0x02, 0x61, 'b', 0x01, 0xff },
+    ) == eq);
+    // 1.5 as a double and as a half.
+    try std.testing.expect(try compareCanonical(
+        allocator,
+        &.{ 0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 },
+        &.{ 0xf9, 0x3e, 0x00 },
+    ) == eq);
+
+    try std.testing.expect(try compareCanonical(allocator, &.{0x01}, &.{0x02}) == .lt);
+    // Integers sort before text: 0x18 0x18 (24) is below 0x61 0x61 ("a").
+    try std.testing.expect(try compareCanonical(allocator, &.{ 0x61, 'a' }, &.{ 0x18, 0x18 }) == .gt);
 }
 
-test "serde deeply nested up 5 levels" {
+test "nested optional fields encode absent, null and present" {
     const allocator = std.testing.allocator;
-    const InnerMost = struct {
-        level: u8 = 5,
-        name: []const u8 = "InnerMost",
-        value: u64,
-    };
-    const Inner = struct {
-        level: u8 = 4,
-        name: []const u8 = "Inner",
-        inner_most: InnerMost,
-    };
-    const Middle = struct {
-        level: u8 = 3,
-        name: []const u8 = "Middle",
-        inner: Inner,
-    };
-    const Outer = struct {
-        level: u8 = 2,
-        name: []const u8 = "Outer",
-        middle: Middle,
+    const Counter = struct { id: u8, count: ??u32 };
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // Outer null: the key is left out even without omit_null_fields.
+    const absent = try serde.serialize(Counter{ .id = 1, .count = null });
+    defer allocator.free(absent);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x62, 'i', 'd', 0x01 }, absent);
+    try std.testing.expect((try serde.deserialize(absent, Counter)).count == null);
+
+    // Inner null: written as CBOR null.
+    const null_count = try serde.serialize(Counter{ .id = 1, .count = @as(?u32, null) });
+    defer allocator.free(null_count);
+    try std.testing.expectEqualSlices(u8, &.{ 0x65, 'c', 'o', 'u', 'n', 't', 0xf6 }, null_count[5..]);
+    const decoded_null = try serde.deserialize(null_count, Counter);
+    try std.testing.expect(decoded_null.count != null and decoded_null.count.? == null);
+
+    const present = try serde.serialize(Counter{ .id = 1, .count = @as(?u32, 7) });
+    defer allocator.free(present);
+    try std.testing.expect((try serde.deserialize(present, Counter)).count.?.? == 7);
+}
+
+test "encodeWithOptions and decodeWithOptions pass options through" {
+    const allocator = std.testing.allocator;
+    const Flags = struct { b: bool, a: ?u8 = null };
+
+    const plain = try encodeWithOptions(allocator, Flags{ .b = true }, .{});
+    defer allocator.free(plain);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa2, 0x61, 'b', 0xf5, 0x61, 'a', 0xf6 }, plain);
+
+    const compact = try encodeWithOptions(allocator, Flags{ .b = true }, .{ .bool_as_int = true, .omit_null_fields = true });
+    defer allocator.free(compact);
+    try std.testing.expectEqualSlices(u8, &.{ 0xa1, 0x61, 'b', 0x01 }, compact);
+
+    try std.testing.expectError(error.TypeMismatch, decodeWithOptions(allocator, Flags, compact, .{}));
+    const decoded = try decodeWithOptions(allocator, Flags, compact, .{ .int_bools = true });
+    defer decoded.deinit();
+    try std.testing.expect(decoded.value.b);
+    try std.testing.expect(decoded.value.a == null);
+}
+
+test "[]DataItem fields keep mixed element types" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    const Bag = struct { id: u8, items: []DataItem };
+    // {"id": 1, "items": [1, "a", true, null, [2]]}
+    const bytes = [_]u8{ 0xa2, 0x62, 'i', 'd', 0x01, 0x65, 'i', 't', 'e', 'm', 's', 0x85, 0x01, 0x61, 'a', 0xf5, 0xf6, 0x81, 0x02 };
+    const bag = try serde.deserialize(&bytes, Bag);
+    try std.testing.expect(bag.id == 1);
+    try std.testing.expect(bag.items.len == 5);
+    try std.testing.expect(bag.items[0].uint == 1);
+    try std.testing.expectEqualStrings("a", bag.items[1].text);
+    try std.testing.expect(bag.items[2].bool);
+    try std.testing.expect(bag.items[3] == .null);
+    try std.testing.expect(bag.items[4].array[0].uint == 2);
+
+    const encoded = try serde.serialize(bag);
+    defer allocator.free(encoded);
+    try std.testing.expectEqualSlices(u8, &bytes, encoded);
+}
+
+test "isCanonical checks core deterministic form" {
+    // {"a": 1, "b": [2]}
+    try std.testing.expect(isCanonical(&.{ 0xa2, 0x61, 'a', 0x01, 0x61, 'b', 0x81, 0x02 }));
+    // 1 with a one-byte argument.
+    try std.testing.expect(!isCanonical(&.{ 0x18, 0x01 }));
+    // {"b": 1, "a": 2}
+    try std.testing.expect(!isCanonical(&.{ 0xa2, 0x61, 'b', 0x01, 0x61, 'a', 0x02 }));
+    // Not well-formed at all.
+    try std.testing.expect(!isCanonical(&.{0x82}));
+}
+
+test "wall-clock nanoseconds encode as tag 1" {
+    const allocator = std.testing.allocator;
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer(), .options = .{ .deterministic = true } };
+
+    try encoder.encodeEpochNanos(1_700_000_000 * std.time.ns_per_s);
+    try std.testing.expectEqualSlices(u8, &.{ 0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00 }, buffer.items);
+
+    buffer.clearRetainingCapacity();
+    try encoder.encodeEpochNanos(-std.time.ns_per_s);
+    try std.testing.expectEqualSlices(u8, &.{ 0xc1, 0x20 }, buffer.items);
+
+    // Fractional seconds become a float, shortened here by `deterministic`.
+    buffer.clearRetainingCapacity();
+    try encoder.encodeEpochNanos(1_500_000_000);
+    try std.testing.expectEqualSlices(u8, &.{ 0xc1, 0xf9, 0x3e, 0x00 }, buffer.items);
+    try std.testing.expect(try decodeEpochNanos(buffer.items) == 1_500_000_000);
+
+    buffer.clearRetainingCapacity();
+    try std.testing.expectError(error.IntegerOutOfRange, encoder.encodeEpochNanos(std.math.maxInt(i128) / std.time.ns_per_s * std.time.ns_per_s));
+}
+
+// Run with `zig build test --fuzz`; without it the seeds run once as a
+// regular test.
+test "fuzz decode" {
+    const seeds = [_][]const u8{
+        // Nested indefinite-length arrays, maps and strings.
+        &.{ 0x9f, 0x9f, 0x9f, 0xff, 0xff, 0xff },
+        &.{ 0xbf, 0x61, 'a', 0x9f, 0x01, 0xff, 0xff },
+        &.{ 0x5f, 0x42, 0x01, 0x02, 0x41, 0x03, 0xff },
+        &.{ 0x7f, 0x5f, 0xff, 0xff },
+        // Arrays nested past the depth limit.
+        &([_]u8{0x81} ** 80 ++ [_]u8{0x00}),
+        &([_]u8{0x9f} ** 80),
+        // Reserved and two-byte simple values, lone break.
+        &.{ 0xf8, 0x10 },
+        &.{ 0xf8, 0xff },
+        &.{0xfc},
+        &.{0xff},
+        &.{ 0x82, 0x01, 0xff },
+        // Lengths far beyond the input.
+        &.{ 0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff },
+        &.{ 0x9b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00 },
+        // Nested tags and an invalid UTF-8 text string.
+        &.{ 0xc1, 0xc2, 0xd8, 0x20, 0x41, 0x00 },
+        &.{ 0x62, 0xc3, 0x28 },
     };
-    const DeeplyNested = struct {
-        level: u8 = 1,
-        name: []const u8 = "DeeplyNested",
-        outer: Outer,
+    const Context = struct {
+        fn testOne(_: @This(), input: []const u8) anyerror!void {
+            // std.testing.allocator reports leaks; safety checks catch UB.
+            var serde = Serde.init(std.testing.allocator, .{});
+            defer serde.deinit();
+            const item = serde.deserialize(input, DataItem) catch return;
+            // Whatever decodes must encode back to well-formed CBOR.
+            const encoded = try serde.serialize(item);
+            defer std.testing.allocator.free(encoded);
+            try validate(encoded);
+        }
     };
+    try std.testing.fuzz(Context{}, Context.testOne, .{ .corpus = &seeds });
+}
 
+test "tuples decode by position with a strict length" {
+    const allocator = std.testing.allocator;
     var serde = Serde.init(allocator, .{});
     defer serde.deinit();
 
-    const original = DeeplyNested{
-        .outer = Outer{
-            .middle = Middle{
-                .inner = Inner{
-                    .inner_most = InnerMost{ .value = 12345 },
-                },
-            },
-        },
-    };
+    const Frame = struct { u8, u16, []const u8 };
+    // [1, 256, h'616263']
+    const bytes = [_]u8{ 0x83, 0x01, 0x19, 0x01, 0x00, 0x43, 'a', 'b', 'c' };
+    const frame = try serde.deserialize(&bytes, Frame);
+    try std.testing.expect(frame[0] == 1);
+    try std.testing.expect(frame[1] == 256);
+    try std.testing.expectEqualStrings("abc", frame[2]);
 
-    const serialized = try serde.serialize(original);
-    defer allocator.free(serialized);
+    const encoded = try serde.serialize(Frame{ 1, 256, "abc" });
+    defer allocator.free(encoded);
+    try std.testing.expectEqualSlices(u8, &bytes, encoded);
 
-    var arena = std.heap.ArenaAllocator.init(allocator);
-    defer arena.deinit();
+    // Too short, too long, and a wrong element type.
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x82, 0x01, 0x02 }, Frame));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x84, 0x01, 0x02, 0x40, 0x00 }, Frame));
+    try std.testing.expectError(error.TypeMismatch, serde.deserialize(&.{ 0x83, 0x61, 'x', 0x02, 0x40 }, Frame));
+}
 
-    const deserialized = try serde.deserialize(serialized, DeeplyNested);
+test "encoder primitives write single bytes" {
+    const allocator = std.testing.allocator;
+    var buffer = std.ArrayList(u8).init(allocator);
+    defer buffer.deinit();
+    var encoder = Encoder{ .writer = buffer.writer() };
 
-    try std.testing.expect(deserialized.outer.middle.inner.inner_most.value == original.outer.middle.inner.inner_most.value);
+    try encoder.encodeBool(false);
+    try encoder.encodeBool(true);
+    try encoder.encodeNull();
+    try encoder.encodeUndefined();
+    try std.testing.expectEqualSlices(u8, &.{ 0xf4, 0xf5, 0xf6, 0xf7 }, buffer.items);
+}
+
+test "tag 1001 extended time" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    // 1001({1: 1700000000, -9: 123456789})
+    const bytes = [_]u8{ 0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x1a, 0x65, 0x53, 0xf1, 0x00, 0x28, 0x1a, 0x07, 0x5b, 0xcd, 0x15 };
+    const time = try serde.deserialize(&bytes, ExtendedTime);
+    try std.testing.expect(time.seconds == 1_700_000_000);
+    try std.testing.expect(time.nanos == 123_456_789);
+
+    const same = try serde.serialize(time);
+    defer allocator.free(same);
+    try std.testing.expectEqualSlices(u8, &bytes, same);
+
+    // Whole milliseconds go under -3: 1001({1: 5, -3: 500})
+    const half = try serde.serialize(ExtendedTime{ .seconds = 5, .nanos = 500_000_000 });
+    defer allocator.free(half);
+    try std.testing.expectEqualSlices(u8, &.{ 0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x05, 0x22, 0x19, 0x01, 0xf4 }, half);
+    try std.testing.expect((try serde.deserialize(half, ExtendedTime)).nanos == 500_000_000);
+
+    // 1001({1: 0, -2: 0}) has an unknown critical key.
+    try std.testing.expectError(error.UnknownCriticalKey, serde.deserialize(&.{ 0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x00, 0x21, 0x00 }, ExtendedTime));
+}
+
+test "decodeSlice fills a caller-provided buffer" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{});
+    defer serde.deinit();
+
+    var out: [3]u16 = undefined;
+    try std.testing.expect(try serde.decodeSlice(u16, &.{ 0x83, 0x01, 0x02, 0x19, 0x01, 0x00 }, &out) == 3);
+    try std.testing.expectEqualSlices(u16, &.{ 1, 2, 256 }, &out);
+
+    try std.testing.expect(try serde.decodeSlice(u16, &.{ 0x9f, 0x07, 0xff }, &out) == 1);
+    try std.testing.expect(out[0] == 7);
+
+    try std.testing.expectError(error.CapacityExceeded, serde.decodeSlice(u16, &.{ 0x84, 0x01, 0x02, 0x03, 0x04 }, &out));
+    try std.testing.expectError(error.CapacityExceeded, serde.decodeSlice(u16, &.{ 0x9f, 0x01, 0x02, 0x03, 0x04, 0xff }, &out));
+}
+
+test "StaticStringMap encodes as a map" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .encode = .{ .deterministic = true } });
+    defer serde.deinit();
+
+    const routes = std.StaticStringMap(u16).initComptime(.{
+        .{ "/users", 2 },
+        .{ "/", 1 },
+    });
+    const encoded = try serde.serialize(routes);
+    defer allocator.free(encoded);
+    // Deterministic order: {"/": 1, "/users": 2}
+    try std.testing.expectEqualSlices(u8, &.{ 0xa2, 0x61, '/', 0x01, 0x66, '/', 'u', 's', 'e', 'r', 's', 0x02 }, encoded);
+
+    const decoded = try serde.deserialize(encoded, std.StringHashMap(u16));
+    try std.testing.expect(decoded.count() == 2);
+    try std.testing.expect(decoded.get("/").? == 1);
+    try std.testing.expect(decoded.get("/users").? == 2);
+}
+
+test "max_string_chunks caps indefinite-length strings" {
+    const allocator = std.testing.allocator;
+    var serde = Serde.init(allocator, .{ .decode = .{ .max_string_chunks = 4 } });
+    defer serde.deinit();
+
+    // (_ h'01', h'0203')
+    const joined = try serde.deserialize(&.{ 0x5f, 0x41, 0x01, 0x42, 0x02, 0x03, 0xff }, []const u8);
+    try std.testing.expectEqualSlices(u8, &.{ 0x01, 0x02, 0x03 }, joined);
+    // (_ "a", "b") into DataItem
+    try std.testing.expectEqualStrings("ab", (try serde.deserialize(&.{ 0x7f, 0x61, 'a', 0x61, 'b', 0xff }, DataItem)).text);
+
+    // Eight one-byte chunks.
+    const many = [_]u8{0x5f} ++ [_]u8{ 0x41, 0xaa } ** 8 ++ [_]u8{0xff};
+    try std.testing.expectError(error.TooManyStringChunks, serde.deserialize(&many, []const u8));
+    try std.testing.expect(errorCategory(error.TooManyStringChunks) == .resource);
+
+    // Chunks must be definite strings of the same type.
+    try std.testing.expectError(error.InvalidStringChunk, serde.deserialize(&.{ 0x5f, 0x61, 'a', 0xff }, []const u8));
+    try std.testing.expect(errorCategory(error.InvalidStringChunk) == .malformed);
+
+    // Chunk lengths are reported like any other non-minimal argument:
+    // (_ h'01' with a one-byte length)
+    const Recorder = struct {
+        count: usize = 0,
+        fn record(context: ?*anyopaque, _: usize) void {
+            const self: *@This() = @ptrCast(@alignCast(context.?));
+            self.count += 1;
+        }
+    };
+    var recorder = Recorder{};
+    var strict = Serde.init(allocator, .{ .decode = .{
+        .on_non_minimal = .{ .context = &recorder, .func = Recorder.record },
+    } });
+    defer strict.deinit();
+    _ = try strict.deserialize(&.{ 0x5f, 0x58, 0x01, 0x01, 0xff }, []const u8);
+    try std.testing.expect(recorder.count == 1);
 }
@@ -1,3 +1,57 @@
 pub const Serde = @import("cbor.zig").Serde;
 pub const Encoder = @import("cbor.zig").Encoder;
-pub const Decoder = @import("cbor.zig").Decoder;
\ No newline at end of file
+pub const SequenceEncoder = @import("cbor.zig").SequenceEncoder;
+pub const Decoder = @import("cbor.zig").Decoder;
+pub const DataItem = @import("cbor.zig").DataItem;
+pub const Builder = @import("cbor.zig").Builder;
+pub const RawCbor = @import("cbor.zig").RawCbor;
+pub const SimpleValue = @import("cbor.zig").SimpleValue;
+pub const ExtendedTime = @import("cbor.zig").ExtendedTime;
+pub const UnionFormat = @import("cbor.zig").UnionFormat;
+pub const DataItemType = @import("cbor.zig").DataItemType;
+pub const ErrorCategory = @import("cbor.zig").ErrorCategory;
+pub const errorCategory = @import("cbor.zig").errorCategory;
+pub const NonMinimalCallback = @import("cbor.zig").NonMinimalCallback;
+pub const peekType = @import("cbor.zig").peekType;
+pub const peekTag = @import("cbor.zig").peekTag;
+pub const TaggedItem = @import("cbor.zig").TaggedItem;
+pub const decodeTag = @import("cbor.zig").decodeTag;
+pub const validate = @import("cbor.zig").validate;
+pub const isWellFormed = @import("cbor.zig").isWellFormed;
+pub const EncodedItem = @import("cbor.zig").EncodedItem;
+pub const copyEncoded = @import("cbor.zig").copyEncoded;
+pub const Head = @import("cbor.zig").Head;
+pub const encodeHead = @import("cbor.zig").encodeHead;
+pub const decodeHead = @import("cbor.zig").decodeHead;
+pub const maxEncodedLen = @import("cbor.zig").maxEncodedLen;
+pub const Decoded = @import("cbor.zig").Decoded;
+pub const encodeWithOptions = @import("cbor.zig").encodeWithOptions;
+pub const decodeWithOptions = @import("cbor.zig").decodeWithOptions;
+pub const encodeToHex = @import("cbor.zig").encodeToHex;
+pub const decodeFromHex = @import("cbor.zig").decodeFromHex;
+pub const toJson = @import("cbor.zig").toJson;
+pub const writeJson = @import("cbor.zig").writeJson;
+pub const Allocators = @import("cbor.zig").Allocators;
+pub const decodeWithAllocators = @import("cbor.zig").decodeWithAllocators;
+pub const Patch = @import("cbor.zig").Patch;
+pub const diff = @import("cbor.zig").diff;
+pub const apply = @import("cbor.zig").apply;
+pub const compareCanonical = @import("cbor.zig").compareCanonical;
+pub const Schema = @import("cbor.zig").Schema;
+pub const Violation = @import("cbor.zig").Violation;
+pub const validateAgainst = @import("cbor.zig").validateAgainst;
+pub const decodeEpochNanos = @import("cbor.zig").decodeEpochNanos;
+pub const toDiagnostic = @import("cbor.zig").toDiagnostic;
+pub const toAnnotatedDiagnostic = @import("cbor.zig").toAnnotatedDiagnostic;
+pub const ValidationError = @import("cbor.zig").ValidationError;
+pub const validateCollect = @import("cbor.zig").validateCollect;
+pub const validateCanonical = @import("cbor.zig").validateCanonical;
+pub const isCanonical = @import("cbor.zig").isCanonical;
+pub const CanonicalProfile = @import("cbor.zig").CanonicalProfile;
+pub const validateCanonicalProfile = @import("cbor.zig").validateCanonicalProfile;
+pub const testing = @import("testing.zig");
+
+test {
+    _ = @import("cbor.zig");
+    _ = @import("testing.zig");
+}
@@ -0,0 +1,96 @@
+const std = @import("std");
+const Allocator = std.mem.Allocator;
+const cbor = @import("cbor.zig");
+
+/// Forwards to `child` while counting allocations and bytes requested.
+pub const CountingAllocator = struct {
+    child: Allocator,
+    allocations: usize = 0,
+    bytes: usize = 0,
+
+    pub fn init(child: Allocator) CountingAllocator {
+        return .{ .child = child };
+    }
+
+    pub fn allocator(self: *CountingAllocator) Allocator {
+        return .{
+            .ptr = self,
+            .vtable = &.{
+                .alloc = alloc,
+                .resize = resize,
+                .remap = remap,
+                .free = free,
+            },
+        };
+    }
+
+    fn alloc(ctx: *anyopaque, len: usize, alignment: std.mem.Alignment, ret_addr: usize) ?[*]u8 {
+        const self: *CountingAllocator = @ptrCast(@alignCast(ctx));
+        self.allocations += 1;
+        self.bytes += len;
+        return self.child.rawAlloc(len, alignment, ret_addr);
+    }
+
+    fn resize(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, new_len: usize, ret_addr: usize) bool {
+        const self: *CountingAllocator = @ptrCast(@alignCast(ctx));
+        if (new_len > memory.len) {
+            self.allocations += 1;
+            self.bytes += new_len - memory.len;
+        }
+        return self.child.rawResize(memory, alignment, new_len, ret_addr);
+    }
+
+    fn remap(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, new_len: usize, ret_addr: usize) ?[*]u8 {
+        const self: *CountingAllocator = @ptrCast(@alignCast(ctx));
+        if (new_len > memory.len) {
+            self.allocations += 1;
+            self.bytes += new_len - memory.len;
+        }
+        return self.child.rawRemap(memory, alignment, new_len, ret_addr);
+    }
+
+    fn free(ctx: *anyopaque, memory: []u8, alignment: std.mem.Alignment, ret_addr: usize) void {
+        const self: *CountingAllocator = @ptrCast(@alignCast(ctx));
+        self.child.rawFree(memory, alignment, ret_addr);
+    }
+};
+
+/// Calls `func` with a counting allocator prepended to `args` and fails with
+/// `error.UnexpectedAllocation` if it allocated anything. For a hard failure
+/// at the point of allocation use `std.testing.failing_allocator` instead.
+pub fn assertNoAlloc(comptime func: anytype, args: anytype) !void {
+    var counting = CountingAllocator.init(std.testing.allocator);
+    const result = @call(.auto, func, .{counting.allocator()} ++ args);
+    if (@typeInfo(@TypeOf(result)) == .error_union) _ = try result;
+    if (counting.allocations != 0) return error.UnexpectedAllocation;
+}
+
+fn validateOnly(_: Allocator, bytes: []const u8) !void {
+    try cbor.validate(bytes);
+}
+
+fn decodeStrings(allocator: Allocator, bytes: []const u8) !void {
+    var serde = cbor.Serde.init(allocator, .{});
+    defer serde.deinit();
+    _ = try serde.deserialize(bytes, [][]const u8);
+}
+
+test "assertNoAlloc passes for allocation-free code" {
+    try assertNoAlloc(validateOnly, .{&[_]u8{ 0x82, 0x61, 'a', 0x41, 'b' }});
+}
+
+test "assertNoAlloc catches an unexpected allocation" {
+    try std.testing.expectError(
+        error.UnexpectedAllocation,
+        assertNoAlloc(decodeStrings, .{&[_]u8{ 0x82, 0x61, 'a', 0x41, 'b' }}),
+    );
+}
+
+test "counting allocator tallies requests" {
+    var counting = CountingAllocator.init(std.testing.allocator);
+    const a = counting.allocator();
+    const buf = try a.alloc(u8, 10);
+    defer a.free(buf);
+    try std.testing.expect(counting.allocations == 1);
+    try std.testing.expect(counting.bytes == 10);
+}